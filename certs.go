@@ -0,0 +1,101 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/certs"
+)
+
+// certsOptions contains the options of `coredump-detector certs generate`
+type certsOptions struct {
+	Service   string
+	Namespace string
+	IPs       []net.IP
+	DNSNames  []string
+	KeyType   string
+	Validity  time.Duration
+	CertDir   string
+}
+
+func (o *certsOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Service, "service", o.Service, ""+
+		"Name of the service in front of the webhook. The server certificate is valid for <service>.<namespace>.svc and its variants.")
+	fs.StringVar(&o.Namespace, "namespace", o.Namespace, "Namespace of the service.")
+	fs.IPSliceVar(&o.IPs, "ip", o.IPs, ""+
+		"IP address kube-apiserver uses to reach the webhook when it runs outside of the cluster. May be repeated.")
+	fs.StringSliceVar(&o.DNSNames, "dns-name", o.DNSNames, "Extra DNS name of the server certificate. May be repeated.")
+	fs.StringVar(&o.KeyType, "key-type", o.KeyType, fmt.Sprintf("Type of the private keys, one of %v.", certs.KeyTypes))
+	fs.DurationVar(&o.Validity, "validity", o.Validity, "How long the certificates are valid.")
+	fs.StringVar(&o.CertDir, "cert-dir", o.CertDir, "Directory to write "+
+		"ca.crt, server.cert, server.key, client.crt and client.key into.")
+}
+
+// config turns the options into the certificates to generate.
+func (o *certsOptions) config() (certs.Config, error) {
+	c := certs.Config{
+		IPs:      o.IPs,
+		DNSNames: o.DNSNames,
+		KeyType:  certs.KeyType(o.KeyType),
+		Validity: o.Validity,
+	}
+	switch {
+	case len(o.Service) != 0:
+		c.CommonName = o.Service + "." + o.Namespace + ".svc"
+		c.DNSNames = append(certs.ServiceDNSNames(o.Service, o.Namespace), c.DNSNames...)
+	case len(o.IPs) != 0:
+		c.CommonName = o.IPs[0].String()
+	case len(o.DNSNames) != 0:
+		c.CommonName = o.DNSNames[0]
+	default:
+		return c, fmt.Errorf("at least one of --service, --ip and --dns-name is required")
+	}
+	return c, nil
+}
+
+// runCerts implements `coredump-detector certs generate`.
+func runCerts(args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return fmt.Errorf("usage: coredump-detector certs generate [flags]")
+	}
+	o := &certsOptions{
+		Namespace: "default",
+		KeyType:   string(certs.RSA2048),
+		Validity:  10 * 365 * 24 * time.Hour,
+		CertDir:   "output",
+	}
+	fs := pflag.NewFlagSet("certs generate", pflag.ContinueOnError)
+	o.addFlags(fs)
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	c, err := o.config()
+	if err != nil {
+		return err
+	}
+	bundle, err := certs.Generate(c)
+	if err != nil {
+		return err
+	}
+	return bundle.WriteFiles(o.CertDir)
+}
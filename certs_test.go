@@ -0,0 +1,65 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertsOptionsConfig(t *testing.T) {
+	o := &certsOptions{Service: "coredump-detector", Namespace: "kube-system", DNSNames: []string{"webhook.example.com"}}
+	c, err := o.config()
+	require.Nil(t, err)
+	assert.Equal(t, "coredump-detector.kube-system.svc", c.CommonName)
+	assert.Equal(t, []string{
+		"coredump-detector",
+		"coredump-detector.kube-system",
+		"coredump-detector.kube-system.svc",
+		"coredump-detector.kube-system.svc.cluster.local",
+		"webhook.example.com",
+	}, c.DNSNames)
+
+	o = &certsOptions{IPs: []net.IP{net.ParseIP("10.167.133.33")}}
+	c, err = o.config()
+	require.Nil(t, err)
+	assert.Equal(t, "10.167.133.33", c.CommonName)
+
+	o = &certsOptions{}
+	_, err = o.config()
+	assert.NotNil(t, err)
+}
+
+func TestRunCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCerts([]string{"generate", "--ip", "10.167.133.33", "--key-type", "ecdsa-p256", "--validity", "1h", "--cert-dir", dir})
+	require.Nil(t, err)
+	for _, name := range []string{"ca.crt", "server.cert", "server.key", "client.crt", "client.key"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.Nil(t, err, "%s is not written", name)
+	}
+
+	assert.NotNil(t, runCerts([]string{"generate", "--key-type", "dsa", "--ip", "10.167.133.33", "--cert-dir", dir}))
+	assert.NotNil(t, runCerts(nil))
+}
@@ -0,0 +1,174 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// certWatcher keeps the serving certificate and the client CA in sync with the files
+// on disk, so that rotated certificates take effect on the next TLS handshake.
+type certWatcher struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	// files are watched together with the certificates, e.g. the caBundle of the webhook.
+	files []string
+	// onReload is called after the certificates are reloaded.
+	onReload func()
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newCertWatcher loads the certificates for the first time.
+func newCertWatcher(certFile, keyFile, clientCAFile string) (*certWatcher, error) {
+	w := &certWatcher{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// load reads the certificates from disk. The certificates in use are only replaced
+// when all the files are valid.
+func (w *certWatcher) load() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	certBytes, err := ioutil.ReadFile(w.clientCAFile)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if ok := clientCAs.AppendCertsFromPEM(certBytes); !ok {
+		return fmt.Errorf("failed to parse client CA file %s", w.clientCAFile)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.cert = &cert
+	w.clientCAs = clientCAs
+	return nil
+}
+
+// GetCertificate returns the serving certificate in use.
+func (w *certWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.cert, nil
+}
+
+// VerifyPeerCertificate verifies the client certificate against the client CA in use.
+func (w *certWatcher) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse client certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	w.lock.RLock()
+	clientCAs := w.clientCAs
+	w.lock.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// tlsConfig returns the TLS config of the webhook server. The client certificates are
+// verified by VerifyPeerCertificate rather than against a fixed ClientCAs, so that a
+// rotated client CA takes effect too. The config itself is never swapped, so the
+// NextProtos added by the http.Server, e.g. for HTTP/2, are kept.
+func (w *certWatcher) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate:        w.GetCertificate,
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: w.VerifyPeerCertificate,
+	}
+}
+
+// watch reloads the certificates whenever something changes in the directories of
+// the files, until stopCh is closed. The directories rather than the files are watched,
+// because secret volumes are updated by swapping a symlink. A failed reload is logged
+// and the certificates in use are kept.
+func (w *certWatcher) watch(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := map[string]bool{}
+	for _, file := range append([]string{w.certFile, w.keyFile, w.clientCAFile}, w.files...) {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			glog.V(4).Infof("certificate directory changed: %v", event)
+			if err := w.load(); err != nil {
+				glog.Errorf("failed to reload certificates, keep using the old ones: %v", err)
+				continue
+			}
+			glog.V(2).Info("reloaded certificates")
+			if w.onReload != nil {
+				w.onReload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			glog.Errorf("error watching certificates: %v", err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSignedCert writes a self signed certificate for commonName and its key to dir.
+func writeSelfSignedCert(t *testing.T, dir, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "server.cert"), certPEM, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "server.key"), keyPEM, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), certPEM, 0644))
+}
+
+// servingCommonName returns the common name of the certificate in use.
+func servingCommonName(t *testing.T, w *certWatcher) string {
+	cert, err := w.GetCertificate(nil)
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeSelfSignedCert(t, dir, "old")
+	w, err := newCertWatcher(filepath.Join(dir, "server.cert"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	require.Nil(t, err)
+	assert.Equal(t, "old", servingCommonName(t, w))
+	oldCert, err := w.GetCertificate(nil)
+	require.Nil(t, err)
+	var reloads int32
+	w.onReload = func() { atomic.AddInt32(&reloads, 1) }
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.watch(stopCh)
+		close(done)
+	}()
+	// give the watcher some time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// a rotated certificate is picked up
+	writeSelfSignedCert(t, dir, "new")
+	assert.Eventually(t, func() bool {
+		cert, _ := w.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName == "new"
+	}, 5*time.Second, 10*time.Millisecond, "rotated certificate is not loaded")
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&reloads) > 0
+	}, 5*time.Second, 10*time.Millisecond, "onReload is not called")
+
+	// so is the rotated client CA
+	newCert, err := w.GetCertificate(nil)
+	require.Nil(t, err)
+	assert.Nil(t, w.VerifyPeerCertificate(newCert.Certificate, nil))
+	assert.NotNil(t, w.VerifyPeerCertificate(oldCert.Certificate, nil), "the client CA is not reloaded")
+	assert.NotNil(t, w.VerifyPeerCertificate(nil, nil))
+
+	// stop watching, so that only the load calls below touch the certificates
+	close(stopCh)
+	<-done
+
+	// a broken certificate is ignored
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "server.cert"), []byte("invalid"), 0644))
+	assert.NotNil(t, w.load())
+	assert.Equal(t, "new", servingCommonName(t, w))
+
+	// so is a broken client CA
+	writeSelfSignedCert(t, dir, "newer")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), []byte("invalid"), 0644))
+	assert.NotNil(t, w.load())
+	assert.Equal(t, "new", servingCommonName(t, w))
+}
+
+func TestCertWatcherServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeSelfSignedCert(t, dir, "server")
+	w, err := newCertWatcher(filepath.Join(dir, "server.cert"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	require.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := &http.Server{
+		TLSConfig: w.tlsConfig(),
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	// the serving certificate is also the client CA, so it is used as the client certificate
+	clientCert, err := w.GetCertificate(nil)
+	require.Nil(t, err)
+	newClient := func(certs []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{Certificates: certs, InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+	resp, err := newClient([]tls.Certificate{*clientCert}).Get("https://" + listener.Addr().String())
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor, "HTTP/2 is not negotiated")
+
+	// clients without a certificate are rejected
+	_, err = newClient(nil).Get("https://" + listener.Addr().String())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,205 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/apis/config/validation"
+	"github.com/CaoShuFeng/coredump-detector/pkg/retention"
+)
+
+// The pod annotations overriding the retention policy of the configuration for the core files of the pod.
+const (
+	retentionMaxAgeAnnotation               = "coredump.fujitsu.com/retention-max-age"
+	retentionMaxCountAnnotation             = "coredump.fujitsu.com/retention-max-count"
+	retentionMaxBytesPerContainerAnnotation = "coredump.fujitsu.com/retention-max-bytes-per-container"
+	retentionMaxBytesPerPodAnnotation       = "coredump.fujitsu.com/retention-max-bytes-per-pod"
+)
+
+// cleanupOptions contains the options of `coredump-detector cleanup`
+type cleanupOptions struct {
+	Dir        string
+	Namespace  string
+	Kubeconfig string
+	ConfigFile string
+	DryRun     bool
+}
+
+func (o *cleanupOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Dir, "dir", o.Dir, "Where the claim holding the core files is mounted.")
+	fs.StringVar(&o.Namespace, "namespace", o.Namespace, ""+
+		"Namespace of the pods writing into the claim. Their annotations override the retention policy of the configuration. "+
+		"Defaults to the POD_NAMESPACE environment variable. The pods are not looked up when it is empty.")
+	fs.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, ""+
+		"Path to a kubeconfig file used to talk to kube-apiserver. The in-cluster config is used when it is empty.")
+	fs.StringVar(&o.ConfigFile, "config", o.ConfigFile, ""+
+		"Path to the Configuration file of the webhook. Its retention is the default retention policy.")
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "Only report the core files which would be deleted.")
+}
+
+// podRetentionPolicy returns the retention policy of a pod, which is defaults
+// overridden by the annotations of the pod.
+func podRetentionPolicy(defaults configv1alpha1.RetentionPolicy, annots map[string]string) (retention.Policy, error) {
+	policy := defaults.DeepCopy()
+	annotationsField := field.NewPath("metadata", "annotations")
+	allErrs := field.ErrorList{}
+	if v, ok := annots[retentionMaxAgeAnnotation]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(annotationsField.Key(retentionMaxAgeAnnotation), v, err.Error()))
+		}
+		policy.MaxAge = &metav1.Duration{Duration: d}
+	}
+	if v, ok := annots[retentionMaxCountAnnotation]; ok {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(annotationsField.Key(retentionMaxCountAnnotation), v, err.Error()))
+		}
+		count := int32(n)
+		policy.MaxCount = &count
+	}
+	for _, a := range []struct {
+		key      string
+		quantity **resource.Quantity
+	}{
+		{retentionMaxBytesPerContainerAnnotation, &policy.MaxBytesPerContainer},
+		{retentionMaxBytesPerPodAnnotation, &policy.MaxBytesPerPod},
+	} {
+		v, ok := annots[a.key]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(v)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(annotationsField.Key(a.key), v, err.Error()))
+		}
+		*a.quantity = &quantity
+	}
+	if len(allErrs) == 0 {
+		allErrs = validation.ValidateRetentionPolicy(policy, annotationsField)
+	}
+	if len(allErrs) != 0 {
+		return retention.Policy{}, allErrs.ToAggregate()
+	}
+	return retentionPolicy(policy), nil
+}
+
+// retentionPolicy converts the retention policy of the configuration.
+func retentionPolicy(p *configv1alpha1.RetentionPolicy) retention.Policy {
+	var policy retention.Policy
+	if p.MaxAge != nil {
+		policy.MaxAge = p.MaxAge.Duration
+	}
+	if p.MaxCount != nil {
+		policy.MaxCount = int(*p.MaxCount)
+	}
+	if p.MaxBytesPerContainer != nil {
+		policy.MaxBytesPerContainer = p.MaxBytesPerContainer.Value()
+	}
+	if p.MaxBytesPerPod != nil {
+		policy.MaxBytesPerPod = p.MaxBytesPerPod.Value()
+	}
+	if p.MaxBytesPerNamespace != nil {
+		policy.MaxBytesPerNamespace = p.MaxBytesPerNamespace.Value()
+	}
+	return policy
+}
+
+// cleanup deletes the core files under dir which exceed the retention policy,
+// and writes a report of them to w. The policy of a pod is read from its
+// annotations in pods, pods which are gone get defaults.
+// With dryRun nothing is deleted.
+func cleanup(dir string, defaults configv1alpha1.RetentionPolicy, pods []corev1.Pod, dryRun bool, w io.Writer, now time.Time) error {
+	files, err := retention.Scan(dir)
+	if err != nil {
+		return err
+	}
+	policies := map[string]retention.Policy{}
+	for _, pod := range pods {
+		policy, err := podRetentionPolicy(defaults, pod.Annotations)
+		if err != nil {
+			glog.Errorf("invalid retention policy of pod %s/%s, the default one is used: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		policies[pod.Name] = policy
+	}
+	deletions := retention.Plan(files, retentionPolicy(&defaults), policies, now)
+	if !dryRun {
+		if err := retention.Delete(deletions); err != nil {
+			return err
+		}
+	}
+	return retention.WriteReport(w, deletions, dryRun, now)
+}
+
+// runCleanup implements `coredump-detector cleanup`.
+func runCleanup(args []string) error {
+	o := &cleanupOptions{
+		Namespace: os.Getenv("POD_NAMESPACE"),
+	}
+	fs := pflag.NewFlagSet("cleanup", pflag.ContinueOnError)
+	o.addFlags(fs)
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	defer glog.Flush()
+	if len(o.Dir) == 0 {
+		return fmt.Errorf("--dir is required")
+	}
+
+	conf := config
+	if len(o.ConfigFile) != 0 {
+		var err error
+		if conf, err = loadConfig(o.ConfigFile); err != nil {
+			return err
+		}
+	}
+
+	var pods []corev1.Pod
+	if len(o.Namespace) != 0 {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", o.Kubeconfig)
+		if err != nil {
+			return err
+		}
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return err
+		}
+		list, err := client.CoreV1().Pods(o.Namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		pods = list.Items
+	}
+	return cleanup(o.Dir, conf.Retention, pods, o.DryRun, os.Stdout, time.Now())
+}
@@ -0,0 +1,131 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/retention"
+)
+
+func TestPodRetentionPolicy(t *testing.T) {
+	maxCount := int32(10)
+	maxBytes := resource.MustParse("1Gi")
+	defaults := configv1alpha1.RetentionPolicy{
+		MaxAge:               &metav1.Duration{Duration: 72 * time.Hour},
+		MaxCount:             &maxCount,
+		MaxBytesPerNamespace: &maxBytes,
+	}
+	testCases := []struct {
+		annotations    map[string]string
+		expectedPolicy retention.Policy
+		expectedError  string
+	}{
+		{
+			expectedPolicy: retention.Policy{MaxAge: 72 * time.Hour, MaxCount: 10, MaxBytesPerNamespace: 1 << 30},
+		},
+		{
+			annotations: map[string]string{
+				retentionMaxAgeAnnotation:               "24h",
+				retentionMaxCountAnnotation:             "3",
+				retentionMaxBytesPerContainerAnnotation: "100Mi",
+				retentionMaxBytesPerPodAnnotation:       "200Mi",
+			},
+			expectedPolicy: retention.Policy{
+				MaxAge:               24 * time.Hour,
+				MaxCount:             3,
+				MaxBytesPerContainer: 100 << 20,
+				MaxBytesPerPod:       200 << 20,
+				MaxBytesPerNamespace: 1 << 30,
+			},
+		},
+		{
+			annotations:   map[string]string{retentionMaxAgeAnnotation: "1 day"},
+			expectedError: "metadata.annotations[coredump.fujitsu.com/retention-max-age]",
+		},
+		{
+			annotations:   map[string]string{retentionMaxCountAnnotation: "0"},
+			expectedError: "metadata.annotations.maxCount",
+		},
+		{
+			annotations:   map[string]string{retentionMaxBytesPerPodAnnotation: "lots"},
+			expectedError: "metadata.annotations[coredump.fujitsu.com/retention-max-bytes-per-pod]",
+		},
+	}
+
+	for i, tc := range testCases {
+		policy, err := podRetentionPolicy(defaults, tc.annotations)
+		if len(tc.expectedError) != 0 {
+			require.NotNil(t, err, "test %d: expected an error", i)
+			assert.Contains(t, err.Error(), tc.expectedError, "test %d: unexpected error", i)
+			continue
+		}
+		require.Nil(t, err, "test %d: unexpected error", i)
+		assert.Equal(t, tc.expectedPolicy, policy, "test %d: unexpected policy", i)
+	}
+	assert.Equal(t, int32(10), *defaults.MaxCount, "the defaults are changed")
+}
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for _, pod := range []string{"pod1", "pod2", "gone"} {
+		path := filepath.Join(dir, pod, "container1", "core_crash_1539000000.100")
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, []byte("core"), 0600))
+		require.Nil(t, os.Chtimes(path, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	}
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Annotations: map[string]string{retentionMaxAgeAnnotation: "1h"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Annotations: map[string]string{retentionMaxAgeAnnotation: "invalid"}}},
+	}
+	defaults := configv1alpha1.RetentionPolicy{MaxAge: &metav1.Duration{Duration: 90 * time.Minute}}
+	exists := func(pod string) bool {
+		_, err := os.Stat(filepath.Join(dir, pod, "container1", "core_crash_1539000000.100"))
+		return err == nil
+	}
+
+	report := &bytes.Buffer{}
+	require.Nil(t, cleanup(dir, configv1alpha1.RetentionPolicy{}, pods, true, report, now))
+	assert.Contains(t, report.String(), "would delete 1 files, 4 bytes", "the annotation is not used without defaults")
+
+	report.Reset()
+	require.Nil(t, cleanup(dir, defaults, pods, true, report, now))
+	assert.Contains(t, report.String(), "would delete 3 files, 12 bytes")
+	assert.True(t, exists("pod1") && exists("pod2") && exists("gone"), "files are deleted in dry run")
+
+	defaults.MaxAge.Duration = 3 * time.Hour
+	report.Reset()
+	require.Nil(t, cleanup(dir, defaults, pods, false, report, now))
+	assert.Contains(t, report.String(), "deleted 1 files, 4 bytes")
+	assert.False(t, exists("pod1"))
+	assert.True(t, exists("pod2"), "the default policy is not used for the invalid annotation")
+	assert.True(t, exists("gone"))
+}
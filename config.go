@@ -0,0 +1,48 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/apis/config/validation"
+)
+
+// config holds the annotation key, mount path and node selector used by the webhook.
+// It is set to the defaults in init, and replaced by the file passed with --config.
+var config *configv1alpha1.Configuration
+
+// loadConfig reads a Configuration from a YAML or JSON file, then defaults and validates it.
+func loadConfig(path string) (*configv1alpha1.Configuration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	obj, gvk, err := codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file %s: %v", path, err)
+	}
+	c, ok := obj.(*configv1alpha1.Configuration)
+	if !ok {
+		return nil, fmt.Errorf("unexpected config type %v in %s", gvk, path)
+	}
+	scheme.Default(c)
+	if errs := validation.ValidateConfiguration(c); len(errs) != 0 {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, errs.ToAggregate())
+	}
+	return c, nil
+}
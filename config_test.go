@@ -0,0 +1,148 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	path := filepath.Join(dir, "config.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	testCases := []struct {
+		content        string
+		expectedConfig *configv1alpha1.Configuration
+		expectedError  string
+	}{
+		{
+			// everything is defaulted
+			content: `
+apiVersion: config.coredump.fujitsu.com/v1alpha1
+kind: Configuration
+`,
+			expectedConfig: &configv1alpha1.Configuration{
+				TypeMeta:      metav1.TypeMeta{APIVersion: "config.coredump.fujitsu.com/v1alpha1", Kind: "Configuration"},
+				AnnotationKey: "coredump.fujitsu.com/pvcname",
+				MountPath:     "/var/coredump",
+				NodeSelector:  map[string]string{"coredump": "true"},
+			},
+		},
+		{
+			content: `
+apiVersion: config.coredump.fujitsu.com/v1alpha1
+kind: Configuration
+annotationKey: example.com/claim
+mountPath: /cores
+nodeSelector:
+  example.com/coredump: enabled
+`,
+			expectedConfig: &configv1alpha1.Configuration{
+				TypeMeta:      metav1.TypeMeta{APIVersion: "config.coredump.fujitsu.com/v1alpha1", Kind: "Configuration"},
+				AnnotationKey: "example.com/claim",
+				MountPath:     "/cores",
+				NodeSelector:  map[string]string{"example.com/coredump": "enabled"},
+			},
+		},
+		{
+			content: `
+apiVersion: config.coredump.fujitsu.com/v1alpha1
+kind: Configuration
+mountPath: cores
+`,
+			expectedError: "mountPath: Invalid value",
+		},
+		{
+			content: `
+apiVersion: v1
+kind: Pod
+`,
+			expectedError: "unexpected config type",
+		},
+		{
+			content: `
+apiVersion: config.coredump.fujitsu.com/v1
+kind: Configuration
+`,
+			expectedError: "failed to decode config file",
+		},
+	}
+
+	for i, tc := range testCases {
+		path := writeConfig(t, tc.content)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		c, err := loadConfig(path)
+		if len(tc.expectedError) != 0 {
+			require.NotNil(t, err, "test %d: expected an error", i)
+			assert.Contains(t, err.Error(), tc.expectedError, "test %d: unexpected error", i)
+			continue
+		}
+		require.Nil(t, err, "test %d: unexpected error", i)
+		assert.Equal(t, tc.expectedConfig, c, "test %d: unexpected config", i)
+	}
+}
+
+func TestMutatePodWithConfig(t *testing.T) {
+	defaultConfig := config
+	defer func() { config = defaultConfig }()
+	config = &configv1alpha1.Configuration{
+		AnnotationKey: "example.com/claim",
+		MountPath:     "/cores",
+		NodeSelector:  map[string]string{"example.com/coredump": "enabled"},
+	}
+
+	raw, err := runtime.Encode(jsonSerializer, &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod1",
+			Annotations: map[string]string{"example.com/claim": "pvc1"},
+		},
+		Spec: corev1.PodSpec{
+			Containers:   []corev1.Container{{Name: "container1"}},
+			NodeSelector: map[string]string{"coredump": "false"},
+		},
+	})
+	require.Nil(t, err)
+	response := mutatePod(admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	assert.Equal(t, &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		PatchType: &patchTypeV1,
+		Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/cores","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/nodeSelector/example.com~1coredump","value":"enabled"},{"op":"add","path":"/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+	}, response)
+}
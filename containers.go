@@ -0,0 +1,82 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// containersAnnotation lists the containers, separated by commas, the coredump volume
+// is mounted to. All the containers are selected when neither it nor
+// excludeContainersAnnotation is set.
+const containersAnnotation = "coredump.fujitsu.com/containers"
+
+// excludeContainersAnnotation lists the containers, separated by commas, the coredump
+// volume is not mounted to, e.g. sidecars injected by a service mesh.
+const excludeContainersAnnotation = "coredump.fujitsu.com/exclude-containers"
+
+// containerFilter selects the init containers and containers of a pod the coredump
+// volume is mounted to. The containers which are not selected are neither mounted
+// nor checked for conflicts.
+type containerFilter struct {
+	// include is the set of the selected containers, everything is selected when it is nil.
+	include map[string]bool
+	// exclude is the set of the containers which are not selected.
+	exclude map[string]bool
+}
+
+// parseContainerFilter returns the containerFilter of the containersAnnotation and
+// excludeContainersAnnotation in annots. Setting both is an error.
+// The names don't have to be in the pod, as sidecars may be injected into it
+// after the coredump volume.
+func parseContainerFilter(annots map[string]string) (containerFilter, error) {
+	include, exclude := annots[containersAnnotation], annots[excludeContainersAnnotation]
+	if len(include) != 0 && len(exclude) != 0 {
+		return containerFilter{}, fmt.Errorf("annotations %s and %s can't be set together", containersAnnotation, excludeContainersAnnotation)
+	}
+	var f containerFilter
+	var err error
+	if len(include) != 0 {
+		f.include, err = parseContainerNames(containersAnnotation, include)
+	}
+	if len(exclude) != 0 {
+		f.exclude, err = parseContainerNames(excludeContainersAnnotation, exclude)
+	}
+	return f, err
+}
+
+// parseContainerNames parses the container names in the value of annotation.
+func parseContainerNames(annotation, value string) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if msgs := validation.IsDNS1123Label(name); len(msgs) != 0 {
+			return nil, fmt.Errorf("invalid container name %q in annotation %s: %s", name, annotation, strings.Join(msgs, ", "))
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+// selects reports whether the coredump volume is mounted to the container name.
+func (f containerFilter) selects(name string) bool {
+	if f.include != nil {
+		return f.include[name]
+	}
+	return !f.exclude[name]
+}
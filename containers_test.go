@@ -0,0 +1,74 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContainerFilter(t *testing.T) {
+	testCases := []struct {
+		annotations   map[string]string
+		selected      []string
+		skipped       []string
+		expectedError string
+	}{
+		{
+			annotations: map[string]string{},
+			selected:    []string{"app", "istio-proxy"},
+		},
+		{
+			annotations: map[string]string{"coredump.fujitsu.com/containers": "app, worker"},
+			selected:    []string{"app", "worker"},
+			skipped:     []string{"istio-proxy"},
+		},
+		{
+			annotations: map[string]string{"coredump.fujitsu.com/exclude-containers": "istio-proxy,fluent-bit"},
+			selected:    []string{"app"},
+			skipped:     []string{"istio-proxy", "fluent-bit"},
+		},
+		{
+			annotations:   map[string]string{"coredump.fujitsu.com/containers": "app,", "coredump.fujitsu.com/exclude-containers": ""},
+			expectedError: `invalid container name ""`,
+		},
+		{
+			annotations:   map[string]string{"coredump.fujitsu.com/exclude-containers": "Istio_Proxy"},
+			expectedError: `invalid container name "Istio_Proxy"`,
+		},
+		{
+			annotations:   map[string]string{"coredump.fujitsu.com/containers": "app", "coredump.fujitsu.com/exclude-containers": "istio-proxy"},
+			expectedError: "can't be set together",
+		},
+	}
+
+	for i, tc := range testCases {
+		f, err := parseContainerFilter(tc.annotations)
+		if len(tc.expectedError) != 0 {
+			require.NotNil(t, err, "test %d: expected an error", i)
+			assert.Contains(t, err.Error(), tc.expectedError, "test %d", i)
+			continue
+		}
+		require.Nil(t, err, "test %d", i)
+		for _, name := range tc.selected {
+			assert.True(t, f.selects(name), "test %d: %s is not selected", i, name)
+		}
+		for _, name := range tc.skipped {
+			assert.False(t, f.selects(name), "test %d: %s is selected", i, name)
+		}
+	}
+}
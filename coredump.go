@@ -0,0 +1,199 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	coredumpv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/coredump/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/cgroup"
+	"github.com/CaoShuFeng/coredump-detector/pkg/ratelimit"
+)
+
+// coreDumpResource is the resource of the CoreDump objects.
+var coreDumpResource = coredumpv1alpha1.SchemeGroupVersion.WithResource("coredumps")
+
+// reasonCoreDumped is the reason of the events emitted for the saved core files.
+const reasonCoreDumped = "CoreDumped"
+
+// coreRecorder creates a CoreDump in the namespace of the pod for every saved core file,
+// and emits a CoreDumped event on the pod.
+type coreRecorder struct {
+	client   kubernetes.Interface
+	dynamic  dynamic.Interface
+	nodeName string
+	// events is where the events are emitted, no event is emitted when it is nil.
+	events record.EventRecorder
+	// eventLimiter limits the events of every pod, so that a crash looping pod
+	// doesn't flood the apiserver.
+	eventLimiter *ratelimit.Limiter
+}
+
+// record creates the CoreDump of the core file saved for c, which ran in container of pod.
+func (r *coreRecorder) record(pod *corev1.Pod, c crash, container cgroup.Container, saved savedCore) (*coredumpv1alpha1.CoreDump, error) {
+	containerName, containerID := findContainer(pod, container.ID)
+	// the container is not in the status yet, but the core is saved into its directory
+	if len(containerName) == 0 {
+		containerName = saved.Container
+	}
+	if len(containerName) == 0 {
+		return nil, fmt.Errorf("container %s is not found in pod %s/%s", container.ID, pod.Namespace, pod.Name)
+	}
+	claim, hostPath := coredumpClaimName(pod), coredumpHostPath(pod)
+	// mountCoredumpVolume mounts the sub path `<pod name>/<container name>` of the claim,
+	// or `<pod uid>/<container name>` of the host path
+	podDir := pod.Name
+	if len(hostPath) != 0 {
+		podDir = string(pod.UID)
+	}
+
+	coreDump := &coredumpv1alpha1.CoreDump{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: coredumpv1alpha1.SchemeGroupVersion.String(),
+			Kind:       "CoreDump",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      coreDumpName(pod.Name, c),
+			Namespace: pod.Namespace,
+		},
+		Spec: coredumpv1alpha1.CoreDumpSpec{
+			PodName:         pod.Name,
+			PodUID:          pod.UID,
+			ContainerName:   containerName,
+			ContainerID:     containerID,
+			NodeName:        r.nodeName,
+			PID:             int32(c.PID),
+			Executable:      c.Exe,
+			Signal:          int32(c.Signal),
+			Size:            saved.Size,
+			ClaimName:       claim,
+			HostPath:        hostPath,
+			Path:            path.Join(podDir, containerName, path.Base(saved.Path)),
+			Time:            metav1.NewTime(time.Unix(c.Time, 0)),
+			Suppressed:      saved.Suppressed,
+			SuppressedCount: int32(saved.SuppressedCount),
+		},
+	}
+	r.emitEvent(pod, coreDump)
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(coreDump)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.dynamic.Resource(coreDumpResource).Namespace(pod.Namespace).Create(context.TODO(), &unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return coreDump, nil
+}
+
+// emitEvent emits the CoreDumped event of coreDump on pod, unless too many events
+// were emitted on pod recently.
+func (r *coreRecorder) emitEvent(pod *corev1.Pod, coreDump *coredumpv1alpha1.CoreDump) {
+	if r.events == nil {
+		return
+	}
+	if r.eventLimiter != nil {
+		allowed, _, err := r.eventLimiter.Allow(string(pod.UID), time.Now())
+		if err != nil {
+			glog.Errorf("failed to rate limit the events of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		} else if !allowed {
+			glog.Infof("too many events on pod %s/%s, skipping the event of %s", pod.Namespace, pod.Name, coreDump.Name)
+			return
+		}
+		if err := r.eventLimiter.Prune(time.Now()); err != nil {
+			glog.Errorf("failed to prune the event rate limits: %v", err)
+		}
+	}
+	spec := coreDump.Spec
+	where := "claim " + spec.ClaimName
+	if len(spec.HostPath) != 0 {
+		where = fmt.Sprintf("%s on node %s", spec.HostPath, spec.NodeName)
+	}
+	if spec.Suppressed {
+		r.events.Eventf(pod, corev1.EventTypeWarning, reasonCoreDumped, "Container %s dumped core on signal %d (%s), %d cores suppressed, saved the metadata to %s.json in %s",
+			spec.ContainerName, spec.Signal, unix.SignalName(syscall.Signal(spec.Signal)), spec.SuppressedCount, spec.Path, where)
+		return
+	}
+	r.events.Eventf(pod, corev1.EventTypeWarning, reasonCoreDumped, "Container %s dumped core on signal %d (%s), saved to %s in %s",
+		spec.ContainerName, spec.Signal, unix.SignalName(syscall.Signal(spec.Signal)), spec.Path, where)
+}
+
+// suppress marks the CoreDump namespace/name suppressed after its core file is deleted.
+func (r *coreRecorder) suppress(namespace, name string) error {
+	patch := []byte(`{"spec":{"suppressed":true}}`)
+	_, err := r.dynamic.Resource(coreDumpResource).Namespace(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// findPod returns the pod with uid running on the node.
+func (r *coreRecorder) findPod(uid string) (*corev1.Pod, error) {
+	pods, err := r.client.CoreV1().Pods(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", r.nodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if string(pods.Items[i].UID) == uid {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("pod %s is not found on node %s", uid, r.nodeName)
+}
+
+// findContainer returns the name and the id of the container with id in the status of pod.
+// The name is empty when the container is not in the status yet.
+func findContainer(pod *corev1.Pod, id string) (name, containerID string) {
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	statuses = append(statuses, pod.Status.EphemeralContainerStatuses...)
+	for _, status := range statuses {
+		// e.g. containerd://<id>
+		if i := strings.Index(status.ContainerID, "://"); i >= 0 && status.ContainerID[i+3:] == id {
+			return status.Name, status.ContainerID
+		}
+	}
+	return "", id
+}
+
+// coreDumpName returns `<pod name>-<time>-<pid>`, with the pod name shortened to keep
+// the name valid.
+func coreDumpName(podName string, c crash) string {
+	suffix := fmt.Sprintf("-%d-%d", c.Time, c.PID)
+	if max := validation.DNS1123SubdomainMaxLength - len(suffix); len(podName) > max {
+		podName = strings.TrimRight(podName[:max], "-.")
+	}
+	return podName + suffix
+}
@@ -0,0 +1,179 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	coredumpv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/coredump/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/cgroup"
+	"github.com/CaoShuFeng/coredump-detector/pkg/ratelimit"
+)
+
+func TestCoreRecorder(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "default", UID: testPodUID},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Volumes: []corev1.Volume{{
+				Name:         coredumpVolumeName,
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "myclaim"}},
+			}},
+		},
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{{Name: "init", ContainerID: "containerd://0123"}},
+			ContainerStatuses:     []corev1.ContainerStatus{{Name: "nginx", ContainerID: "containerd://" + testContainerID}},
+		},
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	r := &coreRecorder{
+		client:   fake.NewClientset(pod),
+		dynamic:  dynamicClient,
+		nodeName: "node-1",
+	}
+	c := crash{PID: 100, TID: 101, Signal: 11, Time: 1539000000, Exe: "nginx"}
+	saved := savedCore{Path: "/proc/100/root/var/coredump/core_nginx_1539000000.100.zst", Size: 4096}
+
+	found, err := r.findPod(testPodUID)
+	require.Nil(t, err)
+	coreDump, err := r.record(found, c, cgroup.Container{PodUID: testPodUID, ID: testContainerID}, saved)
+	require.Nil(t, err)
+	assert.Equal(t, "nginx-1-1539000000-100", coreDump.Name)
+
+	obj, err := dynamicClient.Resource(coreDumpResource).Namespace("default").Get(context.TODO(), "nginx-1-1539000000-100", metav1.GetOptions{})
+	require.Nil(t, err)
+	created := &coredumpv1alpha1.CoreDump{}
+	require.Nil(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, created))
+	assert.Equal(t, "coredump.fujitsu.com/v1alpha1", created.APIVersion)
+	assert.Equal(t, "CoreDump", created.Kind)
+	assert.Equal(t, coredumpv1alpha1.CoreDumpSpec{
+		PodName:       "nginx-1",
+		PodUID:        testPodUID,
+		ContainerName: "nginx",
+		ContainerID:   "containerd://" + testContainerID,
+		NodeName:      "node-1",
+		PID:           100,
+		Executable:    "nginx",
+		Signal:        11,
+		Size:          4096,
+		ClaimName:     "myclaim",
+		Path:          "nginx-1/nginx/core_nginx_1539000000.100.zst",
+		Time:          metav1.NewTime(time.Unix(1539000000, 0)),
+	}, created.Spec)
+
+	// the container is not in the status yet
+	_, err = r.record(found, crash{PID: 200, Signal: 6, Time: 1539000000, Exe: "sh"}, cgroup.Container{PodUID: testPodUID, ID: "4567"}, saved)
+	assert.NotNil(t, err, "the container name is unknown")
+	inSubPath := saved
+	inSubPath.Container = "debugger"
+	coreDump, err = r.record(found, crash{PID: 200, Signal: 6, Time: 1539000000, Exe: "sh"}, cgroup.Container{PodUID: testPodUID, ID: "4567"}, inSubPath)
+	require.Nil(t, err)
+	assert.Equal(t, "debugger", coreDump.Spec.ContainerName)
+	assert.Equal(t, "4567", coreDump.Spec.ContainerID)
+	assert.Equal(t, "nginx-1/debugger/core_nginx_1539000000.100.zst", coreDump.Spec.Path)
+
+	// the pod has a host path volume
+	hostPathPod := found.DeepCopy()
+	hostPathPod.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/coredump/default"}}
+	coreDump, err = r.record(hostPathPod, crash{PID: 300, Signal: 11, Time: 1539000000, Exe: "nginx"}, cgroup.Container{PodUID: testPodUID, ID: testContainerID}, saved)
+	require.Nil(t, err)
+	assert.Equal(t, "", coreDump.Spec.ClaimName)
+	assert.Equal(t, "/var/lib/coredump/default", coreDump.Spec.HostPath)
+	assert.Equal(t, string(testPodUID)+"/nginx/core_nginx_1539000000.100.zst", coreDump.Spec.Path)
+
+	// the pod is gone
+	_, err = r.findPod("0000")
+	assert.NotNil(t, err)
+}
+
+func TestCoreRecorderEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pods := []runtime.Object{
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "default", UID: "uid-1"},
+			Spec: corev1.PodSpec{
+				NodeName: "node-1",
+				Volumes: []corev1.Volume{{
+					Name:         coredumpVolumeName,
+					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "myclaim"}},
+				}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "nginx", ContainerID: "containerd://" + testContainerID}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx-2", Namespace: "default", UID: "uid-2"},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+		},
+	}
+	events := record.NewFakeRecorder(10)
+	r := &coreRecorder{
+		client:       fake.NewClientset(pods...),
+		dynamic:      dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		nodeName:     "node-1",
+		events:       events,
+		eventLimiter: &ratelimit.Limiter{Dir: dir, Burst: 2, Interval: time.Hour},
+	}
+	saved := savedCore{Path: "/proc/100/root/var/coredump/core_nginx_1539000000.100", Size: 4096, Container: "nginx"}
+
+	// a crash looping pod gets two events, the other pod is counted on its own
+	for i, uid := range []string{"uid-1", "uid-1", "uid-1", "uid-2"} {
+		c := crash{PID: 100 + i, Signal: 11, Time: 1539000000, Exe: "nginx"}
+		pod, err := r.findPod(uid)
+		require.Nil(t, err, "test %d", i)
+		_, err = r.record(pod, c, cgroup.Container{PodUID: uid, ID: testContainerID}, saved)
+		require.Nil(t, err, "test %d", i)
+	}
+	close(events.Events)
+	var emitted []string
+	for event := range events.Events {
+		emitted = append(emitted, event)
+	}
+	assert.Equal(t, []string{
+		"Warning CoreDumped Container nginx dumped core on signal 11 (SIGSEGV), saved to nginx-1/nginx/core_nginx_1539000000.100 in claim myclaim",
+		"Warning CoreDumped Container nginx dumped core on signal 11 (SIGSEGV), saved to nginx-1/nginx/core_nginx_1539000000.100 in claim myclaim",
+		"Warning CoreDumped Container nginx dumped core on signal 11 (SIGSEGV), saved to nginx-2/nginx/core_nginx_1539000000.100 in claim ",
+	}, emitted)
+}
+
+func TestCoreDumpName(t *testing.T) {
+	c := crash{PID: 100, Time: 1539000000}
+	assert.Equal(t, "nginx-1-1539000000-100", coreDumpName("nginx-1", c))
+
+	name := coreDumpName(strings.Repeat("a", 240)+"-b", c)
+	assert.Equal(t, 253, len(name))
+	assert.True(t, strings.HasSuffix(name, "a-1539000000-100"), name)
+
+	name = coreDumpName(strings.Repeat("a", 237)+"-bbbbbbb", c)
+	assert.Equal(t, strings.Repeat("a", 237)+"-1539000000-100", name)
+}
@@ -0,0 +1,85 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+)
+
+// decompress writes the core file at path, compressed or not, to w.
+func decompress(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := compression.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %v", path, err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to decompress %s: %v", path, err)
+	}
+	return nil
+}
+
+// runDecompress implements `coredump-detector decompress`. Every file is written
+// next to it without the .gz or .zst extension, or to stdout with --stdout.
+func runDecompress(args []string) error {
+	toStdout := false
+	fs := pflag.NewFlagSet("decompress", pflag.ContinueOnError)
+	fs.BoolVar(&toStdout, "stdout", toStdout, "Write the decompressed core files to stdout.")
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: coredump-detector decompress [--stdout] <core file>...")
+	}
+
+	for _, path := range fs.Args() {
+		if toStdout {
+			if err := decompress(path, os.Stdout); err != nil {
+				return err
+			}
+			continue
+		}
+		output := compression.TrimExtension(path)
+		if output == path {
+			return fmt.Errorf("%s has no extension of %v", path, compression.Algorithms)
+		}
+		out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		err = decompress(path, out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+			return err
+		}
+	}
+	return nil
+}
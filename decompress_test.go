@@ -0,0 +1,56 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+)
+
+func TestRunDecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, a := range []compression.Algorithm{compression.Gzip, compression.Zstd} {
+		path := filepath.Join(dir, "core_"+string(a)+"_1539000000.100"+a.Extension())
+		f, err := os.Create(path)
+		require.Nil(t, err)
+		w, err := compression.NewWriter(a, f)
+		require.Nil(t, err)
+		_, err = w.Write([]byte("core of the crashed process"))
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+		require.Nil(t, f.Close())
+
+		require.Nil(t, runDecompress([]string{path}), string(a))
+		data, err := ioutil.ReadFile(compression.TrimExtension(path))
+		require.Nil(t, err, string(a))
+		assert.Equal(t, "core of the crashed process", string(data), string(a))
+
+		// the output is not overwritten
+		assert.NotNil(t, runDecompress([]string{path}), string(a))
+	}
+
+	assert.NotNil(t, runDecompress([]string{filepath.Join(dir, "core_gzip_1539000000.100")}))
+	assert.NotNil(t, runDecompress(nil))
+}
@@ -0,0 +1,96 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/encryption"
+)
+
+// decrypt writes the core file at path, decrypted with key, to w.
+func decrypt(key []byte, path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := encryption.NewReader(key, f)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %v", path, err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to decrypt %s: %v", path, err)
+	}
+	return nil
+}
+
+// runDecrypt implements `coredump-detector decrypt`. Every file is written next to
+// it without the .enc extension, or to stdout with --stdout.
+func runDecrypt(args []string) error {
+	keyFile := ""
+	toStdout := false
+	fs := pflag.NewFlagSet("decrypt", pflag.ContinueOnError)
+	fs.StringVar(&keyFile, "key-file", keyFile, ""+
+		"Path to the key of the namespace, i.e. the data \""+encryptionKeyName+"\" of its encryption secret.")
+	fs.BoolVar(&toStdout, "stdout", toStdout, "Write the decrypted core files to stdout.")
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(keyFile) == 0 || fs.NArg() == 0 {
+		return fmt.Errorf("usage: coredump-detector decrypt --key-file <key> [--stdout] <core file>...")
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	if err := encryption.ValidateKey(key); err != nil {
+		return fmt.Errorf("invalid key in %s: %v", keyFile, err)
+	}
+
+	for _, path := range fs.Args() {
+		if toStdout {
+			if err := decrypt(key, path, os.Stdout); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(path, encryption.Extension) {
+			return fmt.Errorf("%s has no %s extension", path, encryption.Extension)
+		}
+		output := encryption.TrimExtension(path)
+		out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		err = decrypt(key, path, out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+			return err
+		}
+	}
+	return nil
+}
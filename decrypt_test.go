@@ -0,0 +1,68 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/encryption"
+)
+
+func TestRunDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{1}, encryption.KeySize)
+	keyFile := filepath.Join(dir, "key")
+	require.Nil(t, ioutil.WriteFile(keyFile, key, 0600))
+	otherKeyFile := filepath.Join(dir, "other-key")
+	require.Nil(t, ioutil.WriteFile(otherKeyFile, bytes.Repeat([]byte{2}, encryption.KeySize), 0600))
+	shortKeyFile := filepath.Join(dir, "short-key")
+	require.Nil(t, ioutil.WriteFile(shortKeyFile, key[:16], 0600))
+
+	path := filepath.Join(dir, "core_crash_1539000000.100.zst.enc")
+	f, err := os.Create(path)
+	require.Nil(t, err)
+	w, err := encryption.NewWriter(key, f)
+	require.Nil(t, err)
+	_, err = w.Write([]byte("core of the crashed process"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	require.Nil(t, f.Close())
+
+	// only the holder of the key can decrypt it
+	assert.NotNil(t, runDecrypt([]string{"--key-file", otherKeyFile, path}))
+	_, err = os.Stat(filepath.Join(dir, "core_crash_1539000000.100.zst"))
+	assert.True(t, os.IsNotExist(err), "the output of a failed decryption is kept")
+	assert.NotNil(t, runDecrypt([]string{"--key-file", shortKeyFile, path}))
+
+	require.Nil(t, runDecrypt([]string{"--key-file", keyFile, path}))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "core_crash_1539000000.100.zst"))
+	require.Nil(t, err)
+	assert.Equal(t, "core of the crashed process", string(data))
+
+	// the output is not overwritten
+	assert.NotNil(t, runDecrypt([]string{"--key-file", keyFile, path}))
+	assert.NotNil(t, runDecrypt([]string{"--key-file", keyFile, filepath.Join(dir, "core_crash_1539000000.100.zst")}))
+	assert.NotNil(t, runDecrypt([]string{path}))
+}
@@ -0,0 +1,81 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+// eventRecorder is a record.EventRecorder which creates the events before it returns.
+// `coredump-detector handle` exits right after handling a core, so the events
+// queued by the recorders of client-go would be lost.
+type eventRecorder struct {
+	client kubernetes.Interface
+	source corev1.EventSource
+}
+
+var _ record.EventRecorder = &eventRecorder{}
+
+func (r *eventRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.generateEvent(object, nil, eventtype, reason, message)
+}
+
+func (r *eventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.generateEvent(object, nil, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *eventRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.generateEvent(object, annotations, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *eventRecorder) generateEvent(object runtime.Object, annotations map[string]string, eventtype, reason, message string) {
+	ref, err := reference.GetReference(scheme, object)
+	if err != nil {
+		glog.Errorf("could not construct reference to %#v: %v", object, err)
+		return
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// the same as the recorders of client-go
+			Name:        fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace:   ref.Namespace,
+			Annotations: annotations,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventtype,
+		Source:         r.source,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := r.client.CoreV1().Events(ref.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		glog.Errorf("failed to create event %s/%s: %v", event.Namespace, event.Name, err)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventRecorder(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "default", UID: "uid-1"}}
+	// NewClientset fails the writes of the vendored API types, whose package paths
+	// don't match their OpenAPI names, so the writes are tracked without managed fields.
+	client := fake.NewSimpleClientset(pod)
+	r := &eventRecorder{client: client, source: corev1.EventSource{Component: "coredump-detector", Host: "node-1"}}
+
+	r.Eventf(pod, corev1.EventTypeWarning, reasonCoreDumped, "Container %s dumped core", "nginx")
+
+	events, err := client.CoreV1().Events("default").List(context.TODO(), metav1.ListOptions{})
+	require.Nil(t, err)
+	require.Len(t, events.Items, 1)
+	event := events.Items[0]
+	assert.Equal(t, corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: "default", Name: "nginx-1", UID: "uid-1"}, event.InvolvedObject)
+	assert.Equal(t, corev1.EventTypeWarning, event.Type)
+	assert.Equal(t, reasonCoreDumped, event.Reason)
+	assert.Equal(t, "Container nginx dumped core", event.Message)
+	assert.Equal(t, corev1.EventSource{Component: "coredump-detector", Host: "node-1"}, event.Source)
+	assert.Equal(t, int32(1), event.Count)
+}
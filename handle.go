@@ -0,0 +1,673 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/cgroup"
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+	"github.com/CaoShuFeng/coredump-detector/pkg/elfcore"
+	"github.com/CaoShuFeng/coredump-detector/pkg/encryption"
+	"github.com/CaoShuFeng/coredump-detector/pkg/ratelimit"
+)
+
+// handleOptions contains the options of `coredump-detector handle`
+type handleOptions struct {
+	ProcRoot         string
+	HostDir          string
+	HostCompression  string
+	NodeName         string
+	Kubeconfig       string
+	EncryptionSecret string
+	StateDir         string
+	EventBurst       int
+	EventInterval    time.Duration
+	ConfigFile       string
+}
+
+func (o *handleOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.ProcRoot, "proc-root", o.ProcRoot, "Where the proc filesystem of the node is mounted.")
+	fs.StringVar(&o.HostDir, "host-dir", o.HostDir, ""+
+		"Directory to save the core files of processes which don't run in a pod. They are dropped when it is empty.")
+	fs.StringVar(&o.HostCompression, "host-compression", o.HostCompression, fmt.Sprintf(""+
+		"How to compress the core files saved in --host-dir, one of %v.", compression.Algorithms))
+	fs.StringVar(&o.NodeName, "node-name", o.NodeName, "Name of the node, recorded in the CoreDump objects.")
+	fs.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, ""+
+		"Path to a kubeconfig which can list pods, create CoreDump objects and events. No CoreDump or event is created when it is empty.")
+	fs.StringVar(&o.EncryptionSecret, "encryption-secret", o.EncryptionSecret, ""+
+		"Name of the secret holding the key the cores of the pods in its namespace are encrypted with. Requires --kubeconfig.")
+	fs.StringVar(&o.StateDir, "state-dir", o.StateDir, "Directory to keep the state of the rate limits of the events and the cores in.")
+	fs.IntVar(&o.EventBurst, "event-burst", o.EventBurst, ""+
+		"Number of CoreDumped events emitted on a pod in --event-interval. 0 means unlimited.")
+	fs.DurationVar(&o.EventInterval, "event-interval", o.EventInterval, "Interval the CoreDumped events of a pod are counted in.")
+	fs.StringVar(&o.ConfigFile, "config", o.ConfigFile, ""+
+		"Path to the Configuration file of the webhook. Its mount path is where the core files are written in the containers, and its core limit how many.")
+}
+
+// crash describes the crashed process with the core_pattern specifiers %P %i %s %t %e.
+type crash struct {
+	// PID is the process id in the initial pid namespace.
+	PID int
+	// TID is the id of the thread which triggered the dump, in the initial pid namespace.
+	TID int
+	// Signal is the number of the signal which caused the dump.
+	Signal int
+	// Time is the time of the dump in seconds since the epoch.
+	Time int64
+	// Exe is the executable name of the process.
+	Exe string
+}
+
+// parseCrash parses the arguments passed by the kernel with `|/path/to/coredump-detector handle %P %i %s %t %e`.
+func parseCrash(args []string) (crash, error) {
+	if len(args) != 5 {
+		return crash{}, fmt.Errorf("usage: coredump-detector handle [flags] %%P %%i %%s %%t %%e, got %d arguments", len(args))
+	}
+	var c crash
+	var err error
+	if c.PID, err = strconv.Atoi(args[0]); err != nil {
+		return c, fmt.Errorf("invalid pid %q: %v", args[0], err)
+	}
+	if c.TID, err = strconv.Atoi(args[1]); err != nil {
+		return c, fmt.Errorf("invalid tid %q: %v", args[1], err)
+	}
+	if c.Signal, err = strconv.Atoi(args[2]); err != nil {
+		return c, fmt.Errorf("invalid signal %q: %v", args[2], err)
+	}
+	if c.Time, err = strconv.ParseInt(args[3], 10, 64); err != nil {
+		return c, fmt.Errorf("invalid time %q: %v", args[3], err)
+	}
+	c.Exe = args[4]
+	return c, nil
+}
+
+// fileName returns the name of the core file, the same as core_%e_%t with core_uses_pid set.
+func (c crash) fileName() string {
+	return fmt.Sprintf("core_%s_%d.%d", strings.Replace(c.Exe, "/", "!", -1), c.Time, c.PID)
+}
+
+// partialSuffix is added to the names of the files while they are written, so that
+// `coredump-detector upload` only sees complete files.
+const partialSuffix = ".partial"
+
+// encryptionKeyName is the key of the encryption key in the data of the encryption secrets.
+const encryptionKeyName = "key"
+
+// savedCore is a core file written by coreHandler.
+type savedCore struct {
+	// Path is the path of the core file, as seen from the node.
+	Path string
+	// Size is the size of the core file in bytes, after compression.
+	Size int64
+	// Container is the name of the directory of the core file in the volume, which
+	// is the name of the container for the cores of the pods.
+	Container string
+	// Suppressed is true when only the metadata of the core is saved, in `<Path>.json`.
+	Suppressed bool
+	// SuppressedCount is the number of the cores of the container suppressed
+	// since it was last quiet, this one included.
+	SuppressedCount int
+}
+
+// coreHandler saves the core files piped from the kernel.
+type coreHandler struct {
+	procRoot        string
+	mountPath       string
+	hostDir         string
+	hostCompression compression.Algorithm
+	// recorder creates the CoreDump objects of the cores saved for pods, if not nil.
+	recorder *coreRecorder
+	// encryptionSecret is the name of the secrets holding the keys of the namespaces.
+	// It is looked up with the client of recorder.
+	encryptionSecret string
+	// coreLimit limits the cores saved for every container, if not nil.
+	coreLimit *coreLimit
+}
+
+// handle saves the core of c read from core and returns where it is written.
+// The path is empty when the core is dropped.
+//
+// When the process runs in a container of a pod, the core is written into the mount
+// path of the container. mutatePod mounts the sub path `<pod name>/<container name>`
+// of the claim there, so the core lands in the same place as if the container
+// runtime had written it. Containers without the coredump volume mounted are skipped.
+// The core is compressed as the compressionAnnotation of the pod asks for, then
+// encrypted if the namespace of the pod has an encryption key, and a CoreDump is
+// recorded for it. Failing to record it doesn't fail the handling, but the core
+// is dropped when it can't be told whether it must be encrypted.
+// Only the metadata of the cores beyond the coreLimit of the container is saved.
+func (h *coreHandler) handle(c crash, core io.Reader) (savedCore, error) {
+	container, ok, err := cgroup.Lookup(h.procRoot, c.PID)
+	if err != nil {
+		return savedCore{}, h.drop(core, err)
+	}
+	if !ok {
+		if len(h.hostDir) == 0 {
+			return savedCore{}, h.drop(core, fmt.Errorf("process %d (%s) does not run in a pod", c.PID, c.Exe))
+		}
+		create := func(name string) (*os.File, error) {
+			return os.OpenFile(filepath.Join(h.hostDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		}
+		rename := func(from, to string) error {
+			return os.Rename(filepath.Join(h.hostDir, from), filepath.Join(h.hostDir, to))
+		}
+		return h.save(create, rename, h.hostDir, c, h.hostCompression, nil, core)
+	}
+
+	source, ok, err := h.mountSource(c.PID)
+	if err != nil {
+		return savedCore{}, h.drop(core, err)
+	}
+	if !ok {
+		return savedCore{}, h.drop(core, fmt.Errorf("container %s of pod %s has nothing mounted to %s", container.ID, container.PodUID, h.mountPath))
+	}
+	glog.Infof("saving the core of process %d (%s), thread %d, signal %d, container %s of pod %s, into %s",
+		c.PID, c.Exe, c.TID, c.Signal, container.ID, container.PodUID, source)
+
+	algorithm, err := h.compression(c.PID)
+	if err != nil {
+		glog.Errorf("the core of process %d is not compressed: %v", c.PID, err)
+		algorithm = compression.None
+	}
+	var pod *corev1.Pod
+	if h.recorder != nil {
+		if pod, err = h.recorder.findPod(container.PodUID); err != nil {
+			glog.Errorf("failed to find the pod of process %d: %v", c.PID, err)
+		}
+	}
+	key, err := h.encryptionKey(pod)
+	if err != nil {
+		return savedCore{}, h.drop(core, fmt.Errorf("failed to get the encryption key of pod %s: %v", container.PodUID, err))
+	}
+	uid, gid, err := h.owner(c.PID)
+	if err != nil {
+		// a core owned by root is better than a core lost
+		glog.Errorf("the core of process %d is owned by root: %v", c.PID, err)
+		uid, gid = -1, -1
+	}
+	create := func(name string) (*os.File, error) {
+		f, err := h.createInRoot(c.PID, filepath.Join(h.mountPath, name))
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Chown(uid, gid); err != nil {
+			glog.Errorf("failed to change the owner of %s to %d:%d: %v", f.Name(), uid, gid, err)
+		}
+		return f, nil
+	}
+	rename := func(from, to string) error {
+		return h.renameInRoot(c.PID, h.mountPath, from, to)
+	}
+	dir := filepath.Join(h.procRoot, strconv.Itoa(c.PID), "root", h.mountPath)
+	suppressed, limitKey := 0, coreLimitKey(container.PodUID, source)
+	if h.coreLimit != nil {
+		now := time.Unix(c.Time, 0)
+		if suppressed, err = h.coreLimit.allow(limitKey, now); err != nil {
+			// a core too many is better than a core lost
+			glog.Errorf("failed to limit the cores of container %s of pod %s: %v", container.ID, container.PodUID, err)
+		}
+		if err := h.coreLimit.prune(now); err != nil {
+			glog.Errorf("failed to prune the core limits: %v", err)
+		}
+	}
+	var saved savedCore
+	if suppressed > 0 && h.coreLimit.keepLast == 0 {
+		glog.Infof("container %s of pod %s dumped %d cores too many, saving only the metadata of process %d", container.ID, container.PodUID, suppressed, c.PID)
+		saved, err = h.saveMetadata(create, rename, dir, c, key, core)
+	} else {
+		saved, err = h.save(create, rename, dir, c, algorithm, key, core)
+	}
+	saved.SuppressedCount = suppressed
+	saved.Container = filepath.Base(source)
+	if err != nil {
+		return saved, err
+	}
+	kept := keptCore{Name: filepath.Base(saved.Path)}
+	if pod != nil {
+		if coreDump, err := h.recorder.record(pod, c, container, saved); err != nil {
+			glog.Errorf("failed to record the core of process %d: %v", c.PID, err)
+		} else {
+			glog.Infof("recorded the core of process %d as CoreDump %s/%s", c.PID, coreDump.Namespace, coreDump.Name)
+			kept.Namespace, kept.CoreDump = coreDump.Namespace, coreDump.Name
+		}
+	}
+	if suppressed > 0 && !saved.Suppressed {
+		h.keep(c.PID, limitKey, kept, suppressed == 1)
+	}
+	return saved, nil
+}
+
+// keep adds core to the suppressed cores saved for key, and deletes the ones beyond
+// keepLast from the mount path of process pid. Their CoreDumps are marked suppressed.
+// Failing to do so only leaves more cores behind, so errors are only logged.
+func (h *coreHandler) keep(pid int, key string, core keptCore, first bool) {
+	evicted, err := h.coreLimit.keep(key, core, first)
+	if err != nil {
+		glog.Errorf("failed to keep the core %s: %v", core.Name, err)
+		return
+	}
+	for _, e := range evicted {
+		glog.Infof("deleting the core %s, there are %d newer cores of the container", e.Name, h.coreLimit.keepLast)
+		if err := h.removeInRoot(pid, filepath.Join(h.mountPath, e.Name)); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("failed to delete the core %s: %v", e.Name, err)
+			continue
+		}
+		if len(e.CoreDump) == 0 || h.recorder == nil {
+			continue
+		}
+		if err := h.recorder.suppress(e.Namespace, e.CoreDump); err != nil {
+			glog.Errorf("failed to mark CoreDump %s/%s suppressed: %v", e.Namespace, e.CoreDump, err)
+		}
+	}
+}
+
+// encryptionKey returns the key in the encryptionSecret of the namespace of pod, or
+// nil when the namespace has no such secret or encryption is not enabled.
+func (h *coreHandler) encryptionKey(pod *corev1.Pod) ([]byte, error) {
+	if len(h.encryptionSecret) == 0 || h.recorder == nil {
+		return nil, nil
+	}
+	if pod == nil {
+		return nil, fmt.Errorf("the pod is not found")
+	}
+	secret, err := h.recorder.client.CoreV1().Secrets(pod.Namespace).Get(context.TODO(), h.encryptionSecret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := secret.Data[encryptionKeyName]
+	if err := encryption.ValidateKey(key); err != nil {
+		return nil, fmt.Errorf("invalid %q in secret %s/%s: %v", encryptionKeyName, secret.Namespace, secret.Name, err)
+	}
+	return key, nil
+}
+
+// compression returns the algorithm in the compressionEnv environment variable of process pid.
+func (h *coreHandler) compression(pid int) (compression.Algorithm, error) {
+	data, err := ioutil.ReadFile(filepath.Join(h.procRoot, strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return "", err
+	}
+	prefix := compressionEnv + "="
+	for _, env := range strings.Split(string(data), "\x00") {
+		if strings.HasPrefix(env, prefix) {
+			return compression.Parse(strings.TrimPrefix(env, prefix))
+		}
+	}
+	return compression.None, nil
+}
+
+// owner returns the real user and group IDs of process pid, as seen from the node.
+func (h *coreHandler) owner(pid int) (int, int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(h.procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, 0, err
+	}
+	ids := map[string]int{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "Uid:" && fields[0] != "Gid:") {
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s in the status of process %d: %v", fields[0], pid, err)
+		}
+		ids[fields[0]] = id
+	}
+	uid, ok := ids["Uid:"]
+	if !ok {
+		return 0, 0, fmt.Errorf("no Uid in the status of process %d", pid)
+	}
+	gid, ok := ids["Gid:"]
+	if !ok {
+		return 0, 0, fmt.Errorf("no Gid in the status of process %d", pid)
+	}
+	return uid, gid, nil
+}
+
+// save compresses the core with algorithm, and encrypts it with key if it is not nil,
+// into the file made by create in dir. The core is written with partialSuffix, and
+// is renamed by rename once it is complete. The metadata parsed from the core is
+// written into `<core>.json` next to it, encrypted with key as well. The metadata is parsed while the core is
+// written, so that compressed or encrypted cores don't need to be read back. The
+// core is kept when it can't be parsed.
+func (h *coreHandler) save(create func(name string) (*os.File, error), rename func(from, to string) error, dir string, c crash, algorithm compression.Algorithm, key []byte, core io.Reader) (savedCore, error) {
+	name := c.fileName() + algorithm.Extension()
+	if key != nil {
+		name += encryption.Extension
+	}
+	saved := savedCore{Path: filepath.Join(dir, name)}
+	f, err := create(name + partialSuffix)
+	if err != nil {
+		return savedCore{}, h.drop(core, err)
+	}
+	defer f.Close()
+	out := io.WriteCloser(nopCloser{f})
+	if key != nil {
+		if out, err = encryption.NewWriter(key, f); err != nil {
+			return savedCore{}, h.drop(core, err)
+		}
+	}
+	w, err := compression.NewWriter(algorithm, out)
+	if err != nil {
+		return savedCore{}, h.drop(core, err)
+	}
+
+	// ParseStream always reads to the end, so writing to the pipe never blocks for long
+	pr, pw := io.Pipe()
+	var metadata *elfcore.Metadata
+	parsed := make(chan error, 1)
+	go func() {
+		var err error
+		metadata, err = elfcore.ParseStream(pr)
+		parsed <- err
+	}()
+	_, err = io.Copy(io.MultiWriter(w, pw), core)
+	pw.Close()
+	parseErr := <-parsed
+	if err != nil {
+		return saved, err
+	}
+	if err := w.Close(); err != nil {
+		return saved, err
+	}
+	if err := out.Close(); err != nil {
+		return saved, err
+	}
+	if info, err := f.Stat(); err == nil {
+		saved.Size = info.Size()
+	}
+	if err := f.Close(); err != nil {
+		return saved, err
+	}
+	if err := rename(name+partialSuffix, name); err != nil {
+		return saved, err
+	}
+	if parseErr != nil {
+		glog.Errorf("failed to parse the metadata of %s: %v", saved.Path, parseErr)
+	} else if err := writeMetadata(create, rename, name, key, metadata); err != nil {
+		glog.Errorf("failed to write the metadata of %s: %v", saved.Path, err)
+	}
+	return saved, nil
+}
+
+// saveMetadata writes the metadata parsed from the core of c into `<core>.json` in
+// the file made by create, encrypted with key if it is not nil, without saving the
+// core itself. Nothing is written when
+// the core can't be parsed, but the core still counts as saved, so it is recorded.
+func (h *coreHandler) saveMetadata(create func(name string) (*os.File, error), rename func(from, to string) error, dir string, c crash, key []byte, core io.Reader) (savedCore, error) {
+	name := c.fileName()
+	saved := savedCore{Path: filepath.Join(dir, name), Suppressed: true}
+	metadata, err := elfcore.ParseStream(core)
+	// drain what is left after a parse error
+	io.Copy(ioutil.Discard, core)
+	if err != nil {
+		glog.Errorf("failed to parse the metadata of %s: %v", saved.Path, err)
+		return saved, nil
+	}
+	return saved, writeMetadata(create, rename, name, key, metadata)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// metadataName returns the name of the metadata of the core file name, which is
+// `<core>.json`, or `<core>.json.enc` when it is encrypted with key.
+func metadataName(name string, key []byte) string {
+	if key != nil {
+		return name + ".json" + encryption.Extension
+	}
+	return name + ".json"
+}
+
+// writeMetadata writes m, the metadata of the core file core, into the file made by
+// create, with partialSuffix until it is complete, like save. It is encrypted with
+// key if it is not nil, because the metadata tells about the memory of the process,
+// e.g. its command line and registers.
+func writeMetadata(create func(name string) (*os.File, error), rename func(from, to string) error, core string, key []byte, m *elfcore.Metadata) error {
+	name := metadataName(core, key)
+	f, err := create(name + partialSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := io.WriteCloser(nopCloser{f})
+	if key != nil {
+		if out, err = encryption.NewWriter(key, f); err != nil {
+			return err
+		}
+	}
+	if err := m.Write(out); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return rename(name+partialSuffix, name)
+}
+
+// drop reads the core to the end, so that the kernel is not blocked on the pipe, and returns reason.
+func (h *coreHandler) drop(core io.Reader, reason error) error {
+	io.Copy(ioutil.Discard, core)
+	return fmt.Errorf("dropped the core: %v", reason)
+}
+
+// mountSource returns the root of the mount at the mount path of process pid, e.g.
+// `/exports/<pod name>/<container name>` for a sub path of a nfs volume.
+// ok is false when nothing is mounted there.
+func (h *coreHandler) mountSource(pid int) (source string, ok bool, err error) {
+	f, err := os.Open(filepath.Join(h.procRoot, strconv.Itoa(pid), "mountinfo"))
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// mount-ID parent-ID major:minor root mount-point options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if unescapeMountInfo(fields[4]) == h.mountPath {
+			source = unescapeMountInfo(fields[3])
+			ok = true
+		}
+	}
+	// the last mount on the mount point is the visible one
+	return source, ok, scanner.Err()
+}
+
+var mountInfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+func unescapeMountInfo(s string) string {
+	return mountInfoUnescaper.Replace(s)
+}
+
+// createInRoot creates the file path in the root directory of process pid. Symbolic
+// links are resolved inside of that root, so a container can't redirect the core
+// to a file of the node.
+func (h *coreHandler) createInRoot(pid int, path string) (*os.File, error) {
+	root := filepath.Join(h.procRoot, strconv.Itoa(pid), "root")
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootfd)
+	fd, err := unix.Openat2(rootfd, path, &unix.OpenHow{
+		Flags:   unix.O_WRONLY | unix.O_CREAT | unix.O_EXCL | unix.O_CLOEXEC,
+		Mode:    0600,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(root, path), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(root, path)), nil
+}
+
+// removeInRoot removes the file path in the root directory of process pid, resolving
+// symbolic links inside of that root like createInRoot.
+func (h *coreHandler) removeInRoot(pid int, path string) error {
+	root := filepath.Join(h.procRoot, strconv.Itoa(pid), "root")
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootfd)
+	dirfd, err := unix.Openat2(rootfd, filepath.Dir(path), &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return &os.PathError{Op: "open", Path: filepath.Join(root, filepath.Dir(path)), Err: err}
+	}
+	defer unix.Close(dirfd)
+	if err := unix.Unlinkat(dirfd, filepath.Base(path), 0); err != nil {
+		return &os.PathError{Op: "unlink", Path: filepath.Join(root, path), Err: err}
+	}
+	return nil
+}
+
+// renameInRoot renames the file from to to in the directory dir in the root directory
+// of process pid, resolving symbolic links inside of that root like createInRoot.
+func (h *coreHandler) renameInRoot(pid int, dir, from, to string) error {
+	root := filepath.Join(h.procRoot, strconv.Itoa(pid), "root")
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootfd)
+	dirfd, err := unix.Openat2(rootfd, dir, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return &os.PathError{Op: "open", Path: filepath.Join(root, dir), Err: err}
+	}
+	defer unix.Close(dirfd)
+	if err := unix.Renameat(dirfd, from, dirfd, to); err != nil {
+		return &os.LinkError{Op: "rename", Old: filepath.Join(root, dir, from), New: filepath.Join(root, dir, to), Err: err}
+	}
+	return nil
+}
+
+// runHandle implements `coredump-detector handle`. It is started by the kernel for
+// every core dump when core_pattern is set to
+// `|/path/to/coredump-detector handle %P %i %s %t %e`, with the core on stdin.
+func runHandle(args []string) error {
+	o := &handleOptions{
+		ProcRoot:         "/proc",
+		HostCompression:  string(compression.None),
+		StateDir:         "/run/coredump-detector",
+		EventBurst:       3,
+		EventInterval:    time.Hour,
+		EncryptionSecret: "coredump-encryption",
+	}
+	o.NodeName, _ = os.Hostname()
+	fs := pflag.NewFlagSet("handle", pflag.ContinueOnError)
+	o.addFlags(fs)
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	defer glog.Flush()
+
+	c, err := parseCrash(fs.Args())
+	if err != nil {
+		return err
+	}
+	conf := config
+	if len(o.ConfigFile) != 0 {
+		if conf, err = loadConfig(o.ConfigFile); err != nil {
+			return err
+		}
+	}
+	hostCompression, err := compression.Parse(o.HostCompression)
+	if err != nil {
+		return err
+	}
+	h := &coreHandler{
+		procRoot:         o.ProcRoot,
+		mountPath:        conf.MountPath,
+		hostDir:          o.HostDir,
+		hostCompression:  hostCompression,
+		encryptionSecret: o.EncryptionSecret,
+		coreLimit:        newCoreLimit(conf.CoreLimit, o.StateDir),
+	}
+	if len(o.Kubeconfig) != 0 {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", o.Kubeconfig)
+		if err != nil {
+			return err
+		}
+		h.recorder = &coreRecorder{
+			nodeName: o.NodeName,
+			eventLimiter: &ratelimit.Limiter{
+				Dir:      filepath.Join(o.StateDir, "events"),
+				Burst:    o.EventBurst,
+				Interval: o.EventInterval,
+			},
+		}
+		if h.recorder.client, err = kubernetes.NewForConfig(restConfig); err != nil {
+			return err
+		}
+		h.recorder.events = &eventRecorder{
+			client: h.recorder.client,
+			source: corev1.EventSource{Component: "coredump-detector", Host: o.NodeName},
+		}
+		if h.recorder.dynamic, err = dynamic.NewForConfig(restConfig); err != nil {
+			return err
+		}
+	}
+	saved, err := h.handle(c, os.Stdin)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	if saved.Suppressed {
+		glog.Infof("saved the metadata of the core of process %d (%s) to %s.json", c.PID, c.Exe, saved.Path)
+		return nil
+	}
+	glog.Infof("saved the core of process %d (%s) to %s", c.PID, c.Exe, saved.Path)
+	return nil
+}
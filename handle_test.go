@@ -0,0 +1,353 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+	"github.com/CaoShuFeng/coredump-detector/pkg/elfcore"
+	"github.com/CaoShuFeng/coredump-detector/pkg/encryption"
+)
+
+const (
+	testPodUID      = "3f9d1c2e-5a4b-4c3d-8e7f-1a2b3c4d5e6f"
+	testContainerID = "8e5b8c2a7a3c6d8a9b1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c"
+)
+
+// fakeProcess creates /proc/<pid> of a process under procRoot, with a root directory.
+func fakeProcess(t *testing.T, procRoot, pid, cgroup, mountinfo string) string {
+	dir := filepath.Join(procRoot, pid)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "root"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mountinfo), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "environ"), []byte("PATH=/bin\x00HOME=/root\x00"), 0644))
+	status := fmt.Sprintf("Name:\tcrash\nUid:\t%d\t%d\t%d\t%d\nGid:\t%d\t%d\t%d\t%d\n",
+		os.Getuid(), os.Getuid(), os.Getuid(), os.Getuid(), os.Getgid(), os.Getgid(), os.Getgid(), os.Getgid())
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "status"), []byte(status), 0644))
+	return filepath.Join(dir, "root")
+}
+
+func TestParseCrash(t *testing.T) {
+	c, err := parseCrash([]string{"1234", "1235", "11", "1539000000", "nginx"})
+	require.Nil(t, err)
+	assert.Equal(t, crash{PID: 1234, TID: 1235, Signal: 11, Time: 1539000000, Exe: "nginx"}, c)
+	assert.Equal(t, "core_nginx_1539000000.1234", c.fileName())
+
+	_, err = parseCrash([]string{"1234", "1235", "11", "1539000000"})
+	assert.NotNil(t, err)
+	_, err = parseCrash([]string{"pid", "1235", "11", "1539000000", "nginx"})
+	assert.NotNil(t, err)
+}
+
+func TestCoreHandler(t *testing.T) {
+	procRoot, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(procRoot)
+	hostDir := filepath.Join(procRoot, "host")
+	require.Nil(t, os.Mkdir(hostDir, 0755))
+
+	podCgroup := "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" +
+		strings.Replace(testPodUID, "-", "_", -1) + ".slice/cri-containerd-" + testContainerID + ".scope\n"
+	coredumpMount := "2079 2062 0:52 /exports/nginx-1/nginx /var/coredump rw,relatime - nfs4 10.0.0.1:/exports rw\n"
+	rootMount := "2062 1990 0:50 / / rw,relatime - overlay overlay rw\n"
+
+	// a pod with the coredump volume mounted
+	root := fakeProcess(t, procRoot, "100", podCgroup, rootMount+coredumpMount)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "var", "coredump"), 0755))
+	// a pod without the coredump volume
+	fakeProcess(t, procRoot, "200", podCgroup, rootMount)
+	// a pod which replaced the mount path with a symbolic link out of its root
+	outside := filepath.Join(procRoot, "outside")
+	require.Nil(t, os.Mkdir(outside, 0755))
+	root = fakeProcess(t, procRoot, "300", podCgroup, rootMount+coredumpMount)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "var"), 0755))
+	require.Nil(t, os.Symlink(outside, filepath.Join(root, "var", "coredump")))
+	// a process of the node
+	fakeProcess(t, procRoot, "400", "0::/system.slice/sshd.service\n", rootMount)
+	// a pod asking for gzip
+	root = fakeProcess(t, procRoot, "600", podCgroup, rootMount+coredumpMount)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "var", "coredump"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(procRoot, "600", "environ"), []byte("PATH=/bin\x00COREDUMP_COMPRESSION=gzip\x00"), 0644))
+
+	h := &coreHandler{procRoot: procRoot, mountPath: "/var/coredump"}
+	testCases := []struct {
+		pid          int
+		hostDir      string
+		expectedPath string
+	}{
+		{pid: 100, expectedPath: filepath.Join(procRoot, "100", "root", "var", "coredump", "core_crash_1539000000.100")},
+		{pid: 200},
+		{pid: 300},
+		{pid: 400},
+		{pid: 400, hostDir: hostDir, expectedPath: filepath.Join(hostDir, "core_crash_1539000000.400")},
+		{pid: 500},
+		{pid: 600, expectedPath: filepath.Join(procRoot, "600", "root", "var", "coredump", "core_crash_1539000000.600.gz")},
+	}
+	for _, tc := range testCases {
+		h.hostDir = tc.hostDir
+		core := bytes.NewBufferString("core of the crashed process")
+		saved, err := h.handle(crash{PID: tc.pid, TID: tc.pid, Signal: 11, Time: 1539000000, Exe: "crash"}, core)
+		path := saved.Path
+		assert.Equal(t, tc.expectedPath, path, "pid %d", tc.pid)
+		assert.Equal(t, 0, core.Len(), "pid %d: the core is not read to the end", tc.pid)
+		if len(tc.expectedPath) == 0 {
+			assert.NotNil(t, err, "pid %d", tc.pid)
+			continue
+		}
+		require.Nil(t, err, "pid %d", tc.pid)
+		f, err := os.Open(path)
+		require.Nil(t, err)
+		info, err := f.Stat()
+		require.Nil(t, err)
+		assert.Equal(t, info.Size(), saved.Size, "pid %d", tc.pid)
+		r, err := compression.NewReader(f)
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(r)
+		f.Close()
+		require.Nil(t, err)
+		assert.Equal(t, "core of the crashed process", string(data))
+		_, err = os.Stat(path + ".json")
+		assert.True(t, os.IsNotExist(err), "metadata is written for a core which is not an ELF file")
+	}
+
+	gz, err := ioutil.ReadFile(filepath.Join(procRoot, "600", "root", "var", "coredump", "core_crash_1539000000.600.gz"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{0x1f, 0x8b}, gz[:2], "the core is not compressed")
+
+	files, err := ioutil.ReadDir(outside)
+	require.Nil(t, err)
+	assert.Empty(t, files, "the core is written out of the root of the container")
+
+	partial, err := filepath.Glob(filepath.Join(procRoot, "*", "root", "var", "coredump", "*"+partialSuffix))
+	require.Nil(t, err)
+	assert.Empty(t, partial, "the cores are not renamed once they are written")
+}
+
+func TestCoreHandlerOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of the core needs root")
+	}
+	procRoot, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(procRoot)
+
+	podCgroup := "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" +
+		strings.Replace(testPodUID, "-", "_", -1) + ".slice/cri-containerd-" + testContainerID + ".scope\n"
+	mounts := "2062 1990 0:50 / / rw,relatime - overlay overlay rw\n" +
+		"2079 2062 0:52 /exports/nginx-1/nginx /var/coredump rw,relatime - nfs4 10.0.0.1:/exports rw\n"
+	root := fakeProcess(t, procRoot, "100", podCgroup, mounts)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "var", "coredump"), 0755))
+	status := "Name:\tcrash\nUid:\t1234\t1234\t1234\t1234\nGid:\t5678\t5678\t5678\t5678\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(procRoot, "100", "status"), []byte(status), 0644))
+
+	h := &coreHandler{procRoot: procRoot, mountPath: "/var/coredump"}
+	saved, err := h.handle(crash{PID: 100, TID: 100, Signal: 11, Time: 1539000000, Exe: "crash"}, bytes.NewBufferString("core"))
+	require.Nil(t, err)
+	info, err := os.Stat(saved.Path)
+	require.Nil(t, err)
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(1234), stat.Uid, "the core should be owned by the crashed process")
+	assert.Equal(t, uint32(5678), stat.Gid, "the core should be owned by the crashed process")
+
+	// the core is still saved when the owner is unknown
+	require.Nil(t, os.Remove(filepath.Join(procRoot, "100", "status")))
+	saved, err = h.handle(crash{PID: 100, TID: 100, Signal: 11, Time: 1539000001, Exe: "crash"}, bytes.NewBufferString("core"))
+	require.Nil(t, err)
+	info, err = os.Stat(saved.Path)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(0), info.Sys().(*syscall.Stat_t).Uid)
+}
+
+func TestCoreHandlerEncryption(t *testing.T) {
+	procRoot, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(procRoot)
+
+	key := bytes.Repeat([]byte{1}, encryption.KeySize)
+	var objects []runtime.Object
+	for i, namespace := range []string{"encrypted", "plain", "invalid"} {
+		uid := fmt.Sprintf("%08d-5a4b-4c3d-8e7f-1a2b3c4d5e6f", i)
+		objects = append(objects, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: namespace, UID: types.UID(uid)},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+		})
+		cgroup := "0::/kubepods.slice/kubepods-pod" + strings.Replace(uid, "-", "_", -1) + ".slice/cri-containerd-" + testContainerID + ".scope\n"
+		mounts := "2062 1990 0:50 / / rw,relatime - overlay overlay rw\n" +
+			"2079 2062 0:52 /exports/nginx-1/nginx /var/coredump rw,relatime - nfs4 10.0.0.1:/exports rw\n"
+		root := fakeProcess(t, procRoot, strconv.Itoa(100*(i+1)), cgroup, mounts)
+		require.Nil(t, os.MkdirAll(filepath.Join(root, "var", "coredump"), 0755))
+	}
+	// a pod which is not found
+	root := fakeProcess(t, procRoot, "400", "0::/kubepods.slice/kubepods-pod"+strings.Replace(testPodUID, "-", "_", -1)+".slice/cri-containerd-"+testContainerID+".scope\n",
+		"2079 2062 0:52 /exports/nginx-1/nginx /var/coredump rw,relatime - nfs4 10.0.0.1:/exports rw\n")
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "var", "coredump"), 0755))
+	objects = append(objects,
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "coredump-encryption", Namespace: "encrypted"}, Data: map[string][]byte{"key": key}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "coredump-encryption", Namespace: "invalid"}, Data: map[string][]byte{"key": key[:16]}},
+	)
+
+	h := &coreHandler{
+		procRoot:  procRoot,
+		mountPath: "/var/coredump",
+		recorder: &coreRecorder{
+			client:   fake.NewClientset(objects...),
+			dynamic:  dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+			nodeName: "node-1",
+		},
+		encryptionSecret: "coredump-encryption",
+	}
+	testCases := []struct {
+		pid          int
+		expectedPath string
+		encrypted    bool
+	}{
+		{pid: 100, expectedPath: filepath.Join(procRoot, "100", "root", "var", "coredump", "core_crash_1539000000.100.enc"), encrypted: true},
+		{pid: 200, expectedPath: filepath.Join(procRoot, "200", "root", "var", "coredump", "core_crash_1539000000.200")},
+		{pid: 300},
+		{pid: 400},
+	}
+	for _, tc := range testCases {
+		core := bytes.NewBufferString("core of the crashed process")
+		saved, err := h.handle(crash{PID: tc.pid, TID: tc.pid, Signal: 11, Time: 1539000000, Exe: "crash"}, core)
+		assert.Equal(t, tc.expectedPath, saved.Path, "pid %d", tc.pid)
+		assert.Equal(t, 0, core.Len(), "pid %d: the core is not read to the end", tc.pid)
+		if len(tc.expectedPath) == 0 {
+			assert.NotNil(t, err, "pid %d", tc.pid)
+			continue
+		}
+		require.Nil(t, err, "pid %d", tc.pid)
+		data, err := ioutil.ReadFile(saved.Path)
+		require.Nil(t, err)
+		if tc.encrypted {
+			r, err := encryption.NewReader(key, bytes.NewReader(data))
+			require.Nil(t, err)
+			data, err = ioutil.ReadAll(r)
+			require.Nil(t, err)
+		}
+		assert.Equal(t, "core of the crashed process", string(data), "pid %d", tc.pid)
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	create := func(name string) (*os.File, error) {
+		return os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	rename := func(from, to string) error {
+		return os.Rename(filepath.Join(dir, from), filepath.Join(dir, to))
+	}
+	m := &elfcore.Metadata{Machine: "EM_X86_64", PID: 100, Command: "crash", Args: "crash --password=secret"}
+	expected := &bytes.Buffer{}
+	require.Nil(t, m.Write(expected))
+
+	require.Nil(t, writeMetadata(create, rename, "core_crash_1539000000.100", nil, m))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "core_crash_1539000000.100.json"))
+	require.Nil(t, err)
+	assert.Equal(t, expected.String(), string(data))
+
+	// the metadata of an encrypted core is encrypted too
+	key := bytes.Repeat([]byte{1}, encryption.KeySize)
+	require.Nil(t, writeMetadata(create, rename, "core_crash_1539000000.200.enc", key, m))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "core_crash_1539000000.200.enc.json.enc"))
+	require.Nil(t, err)
+	assert.NotContains(t, string(data), "secret", "the metadata is written in plain text")
+	r, err := encryption.NewReader(key, bytes.NewReader(data))
+	require.Nil(t, err)
+	data, err = ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, expected.String(), string(data))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.Nil(t, err)
+	assert.Len(t, files, 2, "the partial files are not renamed: %v", files)
+}
+
+func TestCoreHandlerCoreLimit(t *testing.T) {
+	procRoot, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(procRoot)
+	cgroup := "0::/kubepods.slice/kubepods-pod" + strings.Replace(testPodUID, "-", "_", -1) + ".slice/cri-containerd-" + testContainerID + ".scope\n"
+	root := fakeProcess(t, procRoot, "100", cgroup, "2079 2062 0:52 /exports/nginx-1/nginx /var/coredump rw,relatime - nfs4 10.0.0.1:/exports rw\n")
+	dir := filepath.Join(root, "var", "coredump")
+	require.Nil(t, os.MkdirAll(dir, 0755))
+
+	for _, keepLast := range []int32{0, 1} {
+		stateDir := filepath.Join(procRoot, fmt.Sprintf("state-%d", keepLast))
+		maxCores := int32(1)
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+		h := &coreHandler{
+			procRoot:  procRoot,
+			mountPath: "/var/coredump",
+			recorder: &coreRecorder{
+				client: fake.NewClientset(&corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "default", UID: types.UID(testPodUID)},
+					Spec:       corev1.PodSpec{NodeName: "node-1"},
+				}),
+				dynamic:  dynamicClient,
+				nodeName: "node-1",
+			},
+			coreLimit: newCoreLimit(configv1alpha1.CoreLimit{MaxCores: &maxCores, KeepLast: &keepLast}, stateDir),
+		}
+
+		start := int64(1539000000) + 10000*int64(keepLast)
+		var paths []string
+		for i := int64(0); i < 3; i++ {
+			core := bytes.NewBufferString("core of the crashed process")
+			saved, err := h.handle(crash{PID: 100, TID: 100, Signal: 11, Time: start + i, Exe: "crash"}, core)
+			require.Nil(t, err, "keepLast %d, core %d", keepLast, i)
+			assert.Equal(t, 0, core.Len(), "keepLast %d, core %d: the core is not read to the end", keepLast, i)
+			assert.Equal(t, int(i), saved.SuppressedCount, "keepLast %d, core %d", keepLast, i)
+			assert.Equal(t, i > 0 && keepLast == 0, saved.Suppressed, "keepLast %d, core %d", keepLast, i)
+			paths = append(paths, saved.Path)
+		}
+
+		// the first core is always kept, the last one only with keepLast
+		for i, expected := range []bool{true, false, keepLast > 0} {
+			_, err := os.Stat(paths[i])
+			assert.Equal(t, expected, err == nil, "keepLast %d, core %d: %v", keepLast, i, err)
+		}
+		// the CoreDumps of the deleted cores are marked suppressed
+		for i := int64(0); i < 3; i++ {
+			name := coreDumpName("nginx-1", crash{PID: 100, Time: start + i})
+			obj, err := dynamicClient.Resource(coreDumpResource).Namespace("default").Get(context.TODO(), name, metav1.GetOptions{})
+			require.Nil(t, err, "keepLast %d, core %d", keepLast, i)
+			suppressed, _, _ := unstructured.NestedBool(obj.Object, "spec", "suppressed")
+			assert.Equal(t, i == 1 || (i == 2 && keepLast == 0), suppressed, "keepLast %d, core %d", keepLast, i)
+		}
+	}
+}
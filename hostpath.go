@@ -0,0 +1,266 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/retention"
+)
+
+// defaultHostPathMaxBytesPerPod and defaultKeepDeletedPods are used when the
+// host path backend of the config doesn't set them.
+var (
+	defaultHostPathMaxBytesPerPod = resource.MustParse("10Gi")
+	defaultKeepDeletedPods        = 24 * time.Hour
+)
+
+// hostPathJanitor looks after the directories of the host path volumes on a node,
+// laid out as `<namespace>/<pod uid>/<container name>` under root. The kubelet creates
+// them as root, so the container directories are given to the user the containers
+// run as. The oldest core files beyond the retention policy or the quota of a pod
+// are deleted, and so are the directories of the pods which are gone, once their
+// core files are older than keepDeletedPods.
+type hostPathJanitor struct {
+	client          kubernetes.Interface
+	nodeName        string
+	root            string
+	retention       configv1alpha1.RetentionPolicy
+	maxBytesPerPod  int64
+	keepDeletedPods time.Duration
+}
+
+// newHostPathJanitor returns the hostPathJanitor of the host path backend of c, whose
+// directory is mounted to root.
+func newHostPathJanitor(client kubernetes.Interface, nodeName, root string, c *configv1alpha1.Configuration) *hostPathJanitor {
+	j := &hostPathJanitor{
+		client:          client,
+		nodeName:        nodeName,
+		root:            root,
+		retention:       c.Retention,
+		maxBytesPerPod:  defaultHostPathMaxBytesPerPod.Value(),
+		keepDeletedPods: defaultKeepDeletedPods,
+	}
+	if c.HostPath.MaxBytesPerPod != nil {
+		j.maxBytesPerPod = c.HostPath.MaxBytesPerPod.Value()
+	}
+	if c.HostPath.KeepDeletedPods != nil {
+		j.keepDeletedPods = c.HostPath.KeepDeletedPods.Duration
+	}
+	return j
+}
+
+// sync does one round over all the namespace directories under root.
+func (j *hostPathJanitor) sync(now time.Time) error {
+	namespaces, err := ioutil.ReadDir(j.root)
+	if os.IsNotExist(err) {
+		// no pod with a host path volume has run on the node yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the directories are read before the pods are listed, so that the pod of every
+	// directory read is in the list unless it is gone
+	podDirs := map[string][]string{}
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+		dirs, err := ioutil.ReadDir(filepath.Join(j.root, ns.Name()))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				podDirs[ns.Name()] = append(podDirs[ns.Name()], dir.Name())
+			}
+		}
+	}
+	list, err := j.client.CoreV1().Pods(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", j.nodeName).String(),
+	})
+	if err != nil {
+		return err
+	}
+	pods := map[string]*corev1.Pod{}
+	for i := range list.Items {
+		pods[string(list.Items[i].UID)] = &list.Items[i]
+	}
+
+	for ns, uids := range podDirs {
+		if err := j.syncNamespace(ns, uids, pods, now); err != nil {
+			glog.Errorf("failed to sync the core files of namespace %s in %s: %v", ns, j.root, err)
+		}
+	}
+	return nil
+}
+
+// syncNamespace syncs the directories uids of the pods of namespace ns.
+func (j *hostPathJanitor) syncNamespace(ns string, uids []string, pods map[string]*corev1.Pod, now time.Time) error {
+	dir := filepath.Join(j.root, ns)
+	defaults := retentionPolicy(&j.retention)
+	defaults.MaxBytesPerPod = minLimit(defaults.MaxBytesPerPod, j.maxBytesPerPod)
+	policies := map[string]retention.Policy{}
+	var gone []string
+	for _, uid := range uids {
+		pod, ok := pods[uid]
+		if !ok || pod.Namespace != ns {
+			gone = append(gone, uid)
+			policy := defaults
+			if policy.MaxAge == 0 || policy.MaxAge > j.keepDeletedPods {
+				policy.MaxAge = j.keepDeletedPods
+			}
+			policies[uid] = policy
+			continue
+		}
+		chownContainerDirs(filepath.Join(dir, uid), pod)
+		policy, err := podRetentionPolicy(j.retention, pod.Annotations)
+		if err != nil {
+			glog.Errorf("invalid retention policy of pod %s/%s, the default one is used: %v", pod.Namespace, pod.Name, err)
+			policy = retentionPolicy(&j.retention)
+		}
+		// the annotations may lower the quota, but not raise it
+		policy.MaxBytesPerPod = minLimit(policy.MaxBytesPerPod, j.maxBytesPerPod)
+		policies[uid] = policy
+	}
+
+	files, err := retention.Scan(dir)
+	if err != nil {
+		return err
+	}
+	deletions := retention.Plan(files, defaults, policies, now)
+	for _, d := range deletions {
+		glog.Infof("deleting %s: %s", d.Path, d.Reason)
+	}
+	if err := retention.Delete(deletions); err != nil {
+		return err
+	}
+
+	deleted := map[string]bool{}
+	for _, d := range deletions {
+		deleted[d.Path] = true
+	}
+	remaining := map[string]bool{}
+	for _, f := range files {
+		if !deleted[f.Path] {
+			remaining[f.Pod] = true
+		}
+	}
+	for _, uid := range gone {
+		if remaining[uid] {
+			continue
+		}
+		glog.Infof("deleting %s, pod %s is gone", filepath.Join(dir, uid), uid)
+		if err := os.RemoveAll(filepath.Join(dir, uid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// minLimit returns the lower of two limits, where 0 is unlimited.
+func minLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// chownContainerDirs gives the directory of every container of pod under dir to the
+// user and group the container runs as. The directories of the containers which
+// run as the user of their image are left alone, as that user is unknown.
+func chownContainerDirs(dir string, pod *corev1.Pod) {
+	var containers []corev1.Container
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for _, ec := range pod.Spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(ec.EphemeralContainerCommon))
+	}
+	for _, container := range containers {
+		uid, gid, ok := containerOwner(pod, container)
+		if !ok {
+			continue
+		}
+		if err := chownDir(filepath.Join(dir, container.Name), uid, gid); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("failed to change the owner of the directory of container %s of pod %s/%s: %v", container.Name, pod.Namespace, pod.Name, err)
+		}
+	}
+}
+
+// containerOwner returns the user and group container runs as, taking the security
+// context of the container before that of the pod. The group falls back to the
+// fsGroup of the pod, then to root like the container runtimes do.
+func containerOwner(pod *corev1.Pod, container corev1.Container) (int, int, bool) {
+	var runAsUser, runAsGroup *int64
+	if sc := pod.Spec.SecurityContext; sc != nil {
+		runAsUser, runAsGroup = sc.RunAsUser, sc.RunAsGroup
+		if runAsGroup == nil {
+			runAsGroup = sc.FSGroup
+		}
+	}
+	if sc := container.SecurityContext; sc != nil {
+		if sc.RunAsUser != nil {
+			runAsUser = sc.RunAsUser
+		}
+		if sc.RunAsGroup != nil {
+			runAsGroup = sc.RunAsGroup
+		}
+	}
+	if runAsUser == nil {
+		return 0, 0, false
+	}
+	gid := 0
+	if runAsGroup != nil {
+		gid = int(*runAsGroup)
+	}
+	return int(*runAsUser), gid, true
+}
+
+// chownDir changes the owner of the directory path, unless it is owned by uid and gid
+// already. The containers can write into the directories, so symbolic links are
+// not followed.
+func chownDir(path string, uid, gid int) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if int(stat.Uid) == uid && int(stat.Gid) == gid {
+		return nil
+	}
+	glog.Infof("changing the owner of %s to %d:%d", path, uid, gid)
+	if err := unix.Fchown(fd, uid, gid); err != nil {
+		return &os.PathError{Op: "chown", Path: path, Err: err}
+	}
+	return nil
+}
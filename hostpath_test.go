@@ -0,0 +1,133 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+func TestHostPathJanitorSync(t *testing.T) {
+	root, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	now := time.Now()
+	writeCore := func(path string, age time.Duration) {
+		path = filepath.Join(root, path)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0750))
+		require.Nil(t, ioutil.WriteFile(path, []byte("core"), 0600))
+		require.Nil(t, os.Chtimes(path, now.Add(-age), now.Add(-age)))
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(root, path))
+		return err == nil
+	}
+	// uid1 runs on the node, uid2 and uid3 are gone
+	writeCore("ns1/uid1/app/core_a_1", 3*time.Hour)
+	writeCore("ns1/uid1/app/core_a_2", 2*time.Hour)
+	writeCore("ns1/uid1/app/core_a_3", time.Hour)
+	writeCore("ns1/uid2/app/core_a_1", 48*time.Hour)
+	writeCore("ns2/uid3/app/core_a_1", time.Hour)
+	// the pod of uid1 in another namespace is not the same pod
+	writeCore("ns2/uid1/app/core_a_1", 48*time.Hour)
+
+	uid, gid := int64(os.Getuid()), int64(os.Getgid())
+	client := fake.NewClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns1", UID: types.UID("uid1")},
+		Spec: corev1.PodSpec{
+			NodeName:        "node1",
+			SecurityContext: &corev1.PodSecurityContext{RunAsUser: &uid, RunAsGroup: &gid},
+			Containers:      []corev1.Container{{Name: "app"}, {Name: "sidecar"}},
+		},
+	})
+	maxBytes := resource.MustParse("8")
+	j := newHostPathJanitor(client, "node1", root, &configv1alpha1.Configuration{
+		HostPath: configv1alpha1.HostPathBackend{
+			MaxBytesPerPod:  &maxBytes,
+			KeepDeletedPods: &metav1.Duration{Duration: 24 * time.Hour},
+		},
+	})
+	require.Nil(t, j.sync(now))
+
+	assert.False(t, exists("ns1/uid1/app/core_a_1"), "the oldest core beyond the quota is kept")
+	assert.True(t, exists("ns1/uid1/app/core_a_2"))
+	assert.True(t, exists("ns1/uid1/app/core_a_3"))
+	assert.False(t, exists("ns1/uid2"), "the directory of the gone pod is kept")
+	assert.True(t, exists("ns2/uid3/app/core_a_1"), "the recent core of the gone pod is deleted")
+	assert.False(t, exists("ns2/uid1"), "the directory of the gone pod is kept")
+
+	// nothing to do when no pod has run on the node
+	j.root = filepath.Join(root, "missing")
+	assert.Nil(t, j.sync(now))
+}
+
+func TestContainerOwner(t *testing.T) {
+	user, group, fsGroup, otherUser := int64(1000), int64(2000), int64(3000), int64(4000)
+	testCases := []struct {
+		pod         *corev1.PodSecurityContext
+		container   *corev1.SecurityContext
+		expectedUID int
+		expectedGID int
+		expectedOK  bool
+	}{
+		{},
+		{pod: &corev1.PodSecurityContext{RunAsGroup: &group}},
+		{pod: &corev1.PodSecurityContext{RunAsUser: &user}, expectedUID: 1000, expectedOK: true},
+		{pod: &corev1.PodSecurityContext{RunAsUser: &user, FSGroup: &fsGroup}, expectedUID: 1000, expectedGID: 3000, expectedOK: true},
+		{
+			pod:         &corev1.PodSecurityContext{RunAsUser: &user, RunAsGroup: &group, FSGroup: &fsGroup},
+			expectedUID: 1000, expectedGID: 2000, expectedOK: true,
+		},
+		{
+			pod:         &corev1.PodSecurityContext{RunAsUser: &user, RunAsGroup: &group},
+			container:   &corev1.SecurityContext{RunAsUser: &otherUser},
+			expectedUID: 4000, expectedGID: 2000, expectedOK: true,
+		},
+		{container: &corev1.SecurityContext{RunAsUser: &user, RunAsGroup: &group}, expectedUID: 1000, expectedGID: 2000, expectedOK: true},
+	}
+	for i, tc := range testCases {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: tc.pod}}
+		uid, gid, ok := containerOwner(pod, corev1.Container{Name: "app", SecurityContext: tc.container})
+		assert.Equal(t, tc.expectedOK, ok, "test %d", i)
+		assert.Equal(t, tc.expectedUID, uid, "test %d", i)
+		assert.Equal(t, tc.expectedGID, gid, "test %d", i)
+	}
+}
+
+func TestChownDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "app"), 0750))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "app"), filepath.Join(dir, "link")))
+
+	assert.Nil(t, chownDir(filepath.Join(dir, "app"), os.Getuid(), os.Getgid()))
+	assert.NotNil(t, chownDir(filepath.Join(dir, "link"), os.Getuid(), os.Getgid()), "the symbolic link is followed")
+	assert.True(t, os.IsNotExist(chownDir(filepath.Join(dir, "missing"), os.Getuid(), os.Getgid())))
+}
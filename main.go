@@ -16,45 +16,86 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"sort"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/mattbaird/jsonpatch"
 	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	k8sjson "k8s.io/apimachinery/pkg/runtime/serializer/json"
-	k8sclock "k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	coredumpv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/coredump/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
 )
 
 var scheme = runtime.NewScheme()
 var codecs = serializer.NewCodecFactory(scheme)
-var clock k8sclock.Clock = &k8sclock.RealClock{}
 
-const annotationKey = `coredump.fujitsu.com/pvcname`
+// coredumpVolumeName is the name of the volume injected into the pod spec.
+// It is fixed, so that a pod mutated before can be recognized.
+const coredumpVolumeName = "coredump"
+
+// podNameEnv is the environment variable injected into every container to expand
+// the pod name in the sub path of the coredump volume.
+const podNameEnv = "COREDUMP_POD_NAME"
+
+// podUIDEnv is injected instead of podNameEnv for host path volumes, whose
+// directories are named after the pod UID.
+const podUIDEnv = "COREDUMP_POD_UID"
+
+// podFieldPaths are the fields of the downward API podNameEnv and podUIDEnv are set to.
+var podFieldPaths = map[string]string{
+	podNameEnv: "metadata.name",
+	podUIDEnv:  "metadata.uid",
+}
+
+// compressionAnnotation chooses how `coredump-detector handle` compresses the core files of the pod.
+const compressionAnnotation = "coredump.fujitsu.com/compression"
+
+// compressionEnv passes the compressionAnnotation of the pod to `coredump-detector handle`,
+// which reads it from the environment of the crashed process.
+const compressionEnv = "COREDUMP_COMPRESSION"
 
 var jsonSerializer *k8sjson.Serializer
 
 func init() {
 	addToScheme(scheme)
 	jsonSerializer = k8sjson.NewSerializer(k8sjson.DefaultMetaFactory, scheme, scheme, false)
+	config = &configv1alpha1.Configuration{}
+	scheme.Default(config)
 }
 
 func addToScheme(scheme *runtime.Scheme) {
 	corev1.AddToScheme(scheme)
 	v1beta1.AddToScheme(scheme)
+	admissionv1.AddToScheme(scheme)
+	appsv1.AddToScheme(scheme)
+	batchv1.AddToScheme(scheme)
+	configv1alpha1.AddToScheme(scheme)
+	coredumpv1alpha1.AddToScheme(scheme)
 }
 
 // Options contains the options passed to k8s audit collector
@@ -63,12 +104,29 @@ type Options struct {
 	KeyFile      string
 	ClientCAFile string
 	Port         uint
+	// MetricsPort serves /healthz, /readyz and /metrics in plain http.
+	MetricsPort uint
+	// MutatePodTemplates enables the mutation of the pod template of workloads
+	// such as deployments and jobs.
+	MutatePodTemplates bool
+	// ValidatePVC enables the validating webhook on path /validate.
+	ValidatePVC bool
+	Kubeconfig  string
+	// ConfigFile is the path to the Configuration file.
+	ConfigFile   string
+	Registration RegistrationOptions
 }
 
 var options = Options{
 	CertFile:     "server.cert",
 	KeyFile:      "server.key",
 	ClientCAFile: "client.crt",
+	Registration: RegistrationOptions{
+		Name:             "coredump",
+		ServiceNamespace: "default",
+		ServicePort:      443,
+		FailurePolicy:    "Ignore",
+	},
 }
 
 func (o *Options) addFlags() {
@@ -80,45 +138,152 @@ func (o *Options) addFlags() {
 	pflag.StringVar(&o.ClientCAFile, "client-ca-file", o.ClientCAFile, ""+
 		"A cert file for the client certificate authority")
 	pflag.UintVar(&o.Port, "bind-port", 443, "The port on which to listen for.")
+	pflag.UintVar(&o.MetricsPort, "metrics-bind-port", 8080, ""+
+		"The port on which to serve /healthz, /readyz and /metrics over plain http. 0 disables it.")
+	pflag.BoolVar(&o.MutatePodTemplates, "mutate-pod-templates", o.MutatePodTemplates, ""+
+		"Mutate the pod template of deployments, statefulsets, daemonsets, replicasets, jobs and cronjobs "+
+		"that carry the coredump annotation, instead of the pods created from them.")
+	pflag.BoolVar(&o.ValidatePVC, "validate-pvc", o.ValidatePVC, ""+
+		"Serve a validating webhook on path /validate, which rejects pods whose persistent volume claim "+
+		"does not exist, is not bound or is not ReadWriteMany.")
+	pflag.StringVar(&o.ConfigFile, "config", o.ConfigFile, ""+
+		"Path to a "+configv1alpha1.SchemeGroupVersion.String()+" Configuration file. "+
+		"The default annotation key, mount path and node selector are used when it is empty.")
+	pflag.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, ""+
+		"Path to a kubeconfig file used to talk to kube-apiserver. The in-cluster config is used when it is empty.")
+	o.Registration.addFlags()
+}
+
+// commands are the subcommands of coredump-detector. Without a subcommand the webhook is started.
+var commands = map[string]func(args []string) error{
+	"certs":      runCerts,
+	"cleanup":    runCleanup,
+	"decompress": runDecompress,
+	"decrypt":    runDecrypt,
+	"handle":     runHandle,
+	"node-agent": runNodeAgent,
+	"upload":     runUpload,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	options.addFlags()
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
-	cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
-	if err != nil {
-		glog.Fatal(err)
+	if len(options.ConfigFile) != 0 {
+		c, err := loadConfig(options.ConfigFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		config = c
 	}
-	certBytes, err := ioutil.ReadFile(options.ClientCAFile)
+
+	certs, err := newCertWatcher(options.CertFile, options.KeyFile, options.ClientCAFile)
 	if err != nil {
-		panic("Unable to read cert.pem")
+		glog.Fatal(err)
 	}
-	clientCertPool := x509.NewCertPool()
-	ok := clientCertPool.AppendCertsFromPEM(certBytes)
-	if !ok {
-		glog.Fatal("failed to parse root certificate")
+
+	http.HandleFunc("/", podHandler)
+	if options.ValidatePVC || options.Registration.Register {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", options.Kubeconfig)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		client, err = kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			glog.Fatal(err)
+		}
 	}
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    clientCertPool,
+	if options.ValidatePVC {
+		http.HandleFunc("/validate", validatingHandler)
 	}
 
-	http.HandleFunc("/", podHandler)
+	if options.MetricsPort != 0 {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%d", options.MetricsPort), newMonitoringMux())
+			glog.Fatal(err)
+		}()
+	}
 
 	server := &http.Server{
 		Addr:      fmt.Sprintf(":%d", options.Port),
-		TLSConfig: config,
+		TLSConfig: certs.tlsConfig(),
 	}
-	err = server.ListenAndServeTLS("", "")
+	listener, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		glog.Fatal(err)
 	}
+	atomic.StoreInt32(&ready, 1)
+
+	if options.Registration.Register {
+		register := func() error {
+			webhookConfig, err := options.Registration.mutatingWebhookConfiguration(options.MutatePodTemplates)
+			if err != nil {
+				return err
+			}
+			return registerWebhook(client, webhookConfig)
+		}
+		if err := register(); err != nil {
+			glog.Fatal(err)
+		}
+		// keep the caBundle of the webhook in sync with the rotated certificates
+		certs.files = []string{options.Registration.CABundleFile}
+		certs.onReload = func() {
+			if err := register(); err != nil {
+				glog.Errorf("failed to register the webhook again: %v", err)
+			}
+		}
+	}
+	go func() {
+		if err := certs.watch(make(chan struct{})); err != nil {
+			glog.Errorf("failed to watch certificates, rotated certificates need a restart: %v", err)
+		}
+	}()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		glog.Info("shutting down")
+		if options.Registration.Register && options.Registration.Unregister {
+			if err := unregisterWebhook(client, options.Registration.Name); err != nil {
+				glog.Errorf("failed to delete MutatingWebhookConfiguration %s: %v", options.Registration.Name, err)
+			}
+		}
+		server.Shutdown(context.Background())
+	}()
+
+	err = server.ServeTLS(listener, "", "")
+	if err != nil && err != http.ErrServerClosed {
+		glog.Fatal(err)
+	}
+	glog.Flush()
 }
 
+// admitFunc handles an admission request and returns the response to send back.
+type admitFunc func(admissionv1.AdmissionReview) *admissionv1.AdmissionResponse
+
 func podHandler(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, instrument("mutating", mutate))
+}
+
+func validatingHandler(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, instrument("validating", validatePod))
+}
+
+// serve decodes the AdmissionReview in the request body, passes it to admit and
+// writes the response in the same AdmissionReview version.
+func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -136,24 +301,63 @@ func podHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	glog.V(2).Info(fmt.Sprintf("handling request: %s", body))
-	var reviewResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
 	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
 		glog.Error(err)
+		decodeFailures.Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		io.WriteString(w, "Failed to decode request body err: "+err.Error())
 		return
-	} else {
-		reviewResponse = mutatePod(ar)
 	}
-	glog.V(2).Info(fmt.Sprintf("sending response: %v", reviewResponse))
 
-	response := v1beta1.AdmissionReview{}
-	if reviewResponse != nil {
-		response.Response = reviewResponse
-		response.Response.UID = ar.Request.UID
+	// reply with the same AdmissionReview version the kube-apiserver sent
+	var response runtime.Object
+	switch *gvk {
+	case v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*v1beta1.AdmissionReview)
+		if !ok {
+			glog.Errorf("expected v1beta1.AdmissionReview but got: %T", obj)
+			decodeFailures.Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, fmt.Sprintf("Unexpected object type %T", obj))
+			return
+		}
+		reviewResponse := admit(admissionv1.AdmissionReview{
+			Request: convertAdmissionRequestToV1(requestedAdmissionReview.Request),
+		})
+		responseAdmissionReview := &v1beta1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		if reviewResponse != nil {
+			responseAdmissionReview.Response = convertAdmissionResponseToV1beta1(reviewResponse)
+			responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		}
+		response = responseAdmissionReview
+	case admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*admissionv1.AdmissionReview)
+		if !ok {
+			glog.Errorf("expected v1.AdmissionReview but got: %T", obj)
+			decodeFailures.Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, fmt.Sprintf("Unexpected object type %T", obj))
+			return
+		}
+		reviewResponse := admit(*requestedAdmissionReview)
+		responseAdmissionReview := &admissionv1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		if reviewResponse != nil {
+			responseAdmissionReview.Response = reviewResponse
+			responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		}
+		response = responseAdmissionReview
+	default:
+		glog.Errorf("unsupported group version kind: %v", gvk)
+		decodeFailures.Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf("Unsupported group version kind: %v", gvk))
+		return
 	}
+	glog.V(2).Info(fmt.Sprintf("sending response: %v", response))
 
 	resp, err := json.Marshal(response)
 	if err != nil {
@@ -166,8 +370,8 @@ func podHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func toAdmissionResponse(err error, code int32) *v1beta1.AdmissionResponse {
-	return &v1beta1.AdmissionResponse{
+func toAdmissionResponse(err error, code int32) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
 		Result: &metav1.Status{
 			Message: err.Error(),
 			Code:    code,
@@ -175,18 +379,33 @@ func toAdmissionResponse(err error, code int32) *v1beta1.AdmissionResponse {
 	}
 }
 
-func allowAdmissionResponse() *v1beta1.AdmissionResponse {
-	return &v1beta1.AdmissionResponse{
+func allowAdmissionResponse() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
 		Allowed: true,
 	}
 }
 
+// mutate passes the request to mutatePodTemplate when it asks for a workload and
+// mutating pod templates is enabled, and to mutatePod otherwise.
+// The subresources are allowed untouched, e.g. the ephemeral containers added by
+// `kubectl debug`: sub paths are not allowed in their volume mounts, and mounting the
+// whole volume would expose the core files of the other pods.
+func mutate(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	if ar.Request != nil && len(ar.Request.SubResource) != 0 {
+		return allowAdmissionResponse()
+	}
+	if ar.Request != nil && options.MutatePodTemplates && podTemplateResources[ar.Request.Resource] {
+		return mutatePodTemplate(ar)
+	}
+	return mutatePod(ar)
+}
+
 // mutatePod do the following things
 // 1) check whether this is a pod creation request, if not return nil. (This is not expected to happen)
-// 2) check whether the pod contains a `coredump.fujitsu.com/pvcname` annotation, if not return Allow directly.
-// 3) mount the persistent volume claim to all containers in the pod
-// 4) set the nodeSelector of the pod. This makes sure the pod can be scheduled to a node that support coredump.
-func mutatePod(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+// 2) check whether the pod contains the coredump annotation (`coredump.fujitsu.com/pvcname` by default) or storageClassAnnotation, if not return Allow directly.
+// 3) mount the persistent volume claim, or an ephemeral volume, to the containers selected by containersAnnotation and excludeContainersAnnotation, all by default
+// 4) set the nodeSelector, or the node affinity, and the tolerations of the pod. This makes sure the pod can be scheduled to a node that support coredump.
+func mutatePod(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	glog.V(2).Info("mutating pods")
 
 	// check the resource
@@ -197,8 +416,8 @@ func mutatePod(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	}
 
 	// check the verb
-	if ar.Request.Operation != v1beta1.Create {
-		glog.Errorf("expect operation to be %s", v1beta1.Create)
+	if ar.Request.Operation != admissionv1.Create {
+		glog.Errorf("expect operation to be %s", admissionv1.Create)
 		return nil
 	}
 
@@ -218,79 +437,45 @@ func mutatePod(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		return toAdmissionResponse(err, http.StatusInternalServerError)
 	}
 
-	pvc := annots[annotationKey]
-	if len(pvc) == 0 {
+	volume, err := coredumpVolume(ar.Request.Namespace, annots)
+	if err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonInvalidAnnotation)
+	}
+	if volume == nil {
 		// no key set, we do nothing
 		return allowAdmissionResponse()
 	}
 
-	// mount the pvc to each container
+	// mount the pvc, or the ephemeral volume of storageClassAnnotation, to each container
 	// note: this pvc meet the following requirements
 	// 1) it should exist in the pod namespace
 	// 2) it should be a RWX volume
-	// However we don't check the existence and attribute of the pvc here.
+	// However we don't check the existence and attribute of the pvc here, see validatePod for that.
 	// When the pvc does not exist, or it could not mount in read write mode, the pod will be failed to create.
 	//
 	// TODO figure out how namespaced pvc work with non-namespaced static pods
-	for i := range pod.Spec.InitContainers {
-		if err := checkVolumeMounts(pod.Spec.InitContainers[i], pvc); err != nil {
-			return toAdmissionResponse(err, http.StatusBadRequest)
-		}
-	}
-	for i := range pod.Spec.Containers {
-		if err := checkVolumeMounts(pod.Spec.Containers[i], pvc); err != nil {
-			return toAdmissionResponse(err, http.StatusBadRequest)
-		}
+	algorithm, err := compression.Parse(annots[compressionAnnotation])
+	if err != nil {
+		return rejectAdmissionResponse(fmt.Errorf("invalid annotation %s: %v", compressionAnnotation, err), http.StatusBadRequest, reasonInvalidAnnotation)
 	}
-	for _, volume := range pod.Spec.Volumes {
-		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc {
-			return toAdmissionResponse(fmt.Errorf("%s is already in the volume list, this is not expected.", pvc), http.StatusBadRequest)
-		}
+	containers, err := parseContainerFilter(annots)
+	if err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonInvalidAnnotation)
 	}
-
 	newPod := pod.DeepCopy()
-
-	// append the volume to volume list
-	volumeName := fmt.Sprintf("%s-%d", pvc, clock.Now().Unix())
-	volume := corev1.Volume{
-		volumeName,
-		corev1.VolumeSource{
-			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-				ClaimName: pvc,
-				ReadOnly:  false,
-			},
-		},
+	if err := injectCoredumpVolume(&newPod.Spec, *volume, algorithm, containers); err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonMountConflict)
+	}
+	if err := scheduleToCoredumpNodes(&newPod.Spec); err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonSchedulingConflict)
 	}
-	newPod.Spec.Volumes = append(newPod.Spec.Volumes, volume)
 
-	// mount the volume to each container
-	for i := range newPod.Spec.InitContainers {
-		newPod.Spec.InitContainers[i].VolumeMounts = append(newPod.Spec.InitContainers[i].VolumeMounts,
-			corev1.VolumeMount{
-				Name:      volumeName,
-				ReadOnly:  false,
-				MountPath: "/var/coredump",
-				SubPath:   newPod.Name + "/" + newPod.Spec.InitContainers[i].Name,
-			})
-	}
-	for i := range newPod.Spec.Containers {
-		newPod.Spec.Containers[i].VolumeMounts = append(newPod.Spec.Containers[i].VolumeMounts,
-			corev1.VolumeMount{
-				Name:      volumeName,
-				ReadOnly:  false,
-				MountPath: "/var/coredump",
-				SubPath:   newPod.Name + "/" + newPod.Spec.Containers[i].Name,
-			})
-	}
-
-	// set node selector:
-	if newPod.Spec.NodeSelector != nil {
-		newPod.Spec.NodeSelector["coredump"] = "true"
-	} else {
-		newPod.Spec.NodeSelector = map[string]string{"coredump": "true"}
-	}
-
-	objJS, err := runtime.Encode(jsonSerializer, newPod)
+	return patchAdmissionResponse(raw, newPod)
+}
+
+// patchAdmissionResponse allows the request and patches the original object raw into obj.
+func patchAdmissionResponse(raw []byte, obj runtime.Object) *admissionv1.AdmissionResponse {
+	objJS, err := runtime.Encode(jsonSerializer, obj)
 	if err != nil {
 		return toAdmissionResponse(err, http.StatusInternalServerError)
 	}
@@ -300,20 +485,149 @@ func mutatePod(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	}
 	glog.V(5).Infof("Created patch :%s", patch)
 
-	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse := admissionv1.AdmissionResponse{}
 	reviewResponse.Allowed = true
 	reviewResponse.Patch = patch
-	var patchType = v1beta1.PatchTypeJSONPatch
+	var patchType = admissionv1.PatchTypeJSONPatch
 	reviewResponse.PatchType = &patchType
 	return &reviewResponse
 }
 
-// checkVolumeMounts ensures that the path `/var/coredump` is not mounted with another volume.
+// injectCoredumpVolume appends the coredump volume to the volume list of spec, and mounts it to the
+// configured mount path of every init container and container selected by containers.
+// The sub path of each mount is `<pod name>/<container name>`, or `<pod uid>/<container name>`
+// for host path volumes. The pod name and UID are taken from the downward API at runtime,
+// because pods created with generateName have neither when they are admitted.
+// The algorithm, unless it is none, is passed in compressionEnv.
+//
+// Whatever has been injected already is left as it is, so calling injectCoredumpVolume
+// on its own output changes nothing. This keeps the webhook safe to be reinvoked
+// by the kube-apiserver (reinvocationPolicy: IfNeeded).
+func injectCoredumpVolume(spec *corev1.PodSpec, coredump corev1.Volume, algorithm compression.Algorithm, containers containerFilter) error {
+	name, env := describeCoredumpVolume(coredump), subPathVariable(coredump)
+	for i := range spec.InitContainers {
+		if !containers.selects(spec.InitContainers[i].Name) {
+			continue
+		}
+		if err := checkVolumeMounts(spec.InitContainers[i], name); err != nil {
+			return err
+		}
+		if err := checkEnv(spec.InitContainers[i], env, algorithm); err != nil {
+			return err
+		}
+	}
+	for i := range spec.Containers {
+		if !containers.selects(spec.Containers[i].Name) {
+			continue
+		}
+		if err := checkVolumeMounts(spec.Containers[i], name); err != nil {
+			return err
+		}
+		if err := checkEnv(spec.Containers[i], env, algorithm); err != nil {
+			return err
+		}
+	}
+	injected := false
+	for _, volume := range spec.Volumes {
+		if volume.Name == coredumpVolumeName {
+			if !sameCoredumpVolume(volume, coredump) {
+				return fmt.Errorf("volume %q is already in the volume list and does not refer to %s, this is not expected.", coredumpVolumeName, name)
+			}
+			injected = true
+			continue
+		}
+		if coredump.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == coredump.PersistentVolumeClaim.ClaimName {
+			return fmt.Errorf("%s is already in the volume list, this is not expected.", name)
+		}
+	}
+
+	// append the volume to volume list
+	if !injected {
+		spec.Volumes = append(spec.Volumes, coredump)
+	}
+
+	// mount the volume to each container
+	for i := range spec.InitContainers {
+		if containers.selects(spec.InitContainers[i].Name) {
+			mountCoredumpVolume(&spec.InitContainers[i], env, algorithm)
+		}
+	}
+	for i := range spec.Containers {
+		if containers.selects(spec.Containers[i].Name) {
+			mountCoredumpVolume(&spec.Containers[i], env, algorithm)
+		}
+	}
+	return nil
+}
+
+// mountCoredumpVolume mounts the coredump volume to the mount path of the container,
+// unless it has been mounted already. The pod name or UID used in the sub path is
+// exposed to the container in the env environment variable, podNameEnv or podUIDEnv.
+func mountCoredumpVolume(container *corev1.Container, env string, algorithm compression.Algorithm) {
+	hasEnv, hasCompressionEnv := false, false
+	for i := range container.Env {
+		switch container.Env[i].Name {
+		case env:
+			hasEnv = true
+		case compressionEnv:
+			hasCompressionEnv = true
+		}
+	}
+	if !hasCompressionEnv && algorithm != compression.None {
+		container.Env = append(container.Env, corev1.EnvVar{Name: compressionEnv, Value: string(algorithm)})
+	}
+	if !hasEnv {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name: env,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					APIVersion: "v1",
+					FieldPath:  podFieldPaths[env],
+				},
+			},
+		})
+	}
+
+	for i := range container.VolumeMounts {
+		if container.VolumeMounts[i].Name == coredumpVolumeName && container.VolumeMounts[i].MountPath == config.MountPath {
+			return
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts,
+		corev1.VolumeMount{
+			Name:        coredumpVolumeName,
+			ReadOnly:    false,
+			MountPath:   config.MountPath,
+			SubPathExpr: "$(" + env + ")/" + container.Name,
+		})
+}
+
+// checkEnv ensures that the env and compressionEnv environment variables,
+// if the container has them already, hold the pod field of env and algorithm.
+func checkEnv(container corev1.Container, env string, algorithm compression.Algorithm) error {
+	for _, e := range container.Env {
+		if e.Name == compressionEnv && (e.ValueFrom != nil || e.Value != string(algorithm)) {
+			return fmt.Errorf("Failed to set environment variable %q in container %q, it is already set to another value",
+				compressionEnv, container.Name)
+		}
+		if e.Name != env {
+			continue
+		}
+		if e.ValueFrom == nil || e.ValueFrom.FieldRef == nil || e.ValueFrom.FieldRef.FieldPath != podFieldPaths[env] {
+			return fmt.Errorf("Failed to set environment variable %q in container %q, it is already set to another value",
+				env, container.Name)
+		}
+	}
+	return nil
+}
+
+// checkVolumeMounts ensures that the mount path is not mounted with another volume.
+// pvc names the coredump volume in the error.
 func checkVolumeMounts(container corev1.Container, pvc string) error {
 	for i := range container.VolumeMounts {
-		if container.VolumeMounts[i].MountPath == "/var/coredump" {
-			return fmt.Errorf("Failed to mount the volume %q to path \"/var/coredump\" in container %q, volume %q is already mounted to the path",
-				pvc, container.Name, container.VolumeMounts[i].Name)
+		if container.VolumeMounts[i].MountPath == config.MountPath && container.VolumeMounts[i].Name != coredumpVolumeName {
+			return fmt.Errorf("Failed to mount the volume %q to path %q in container %q, volume %q is already mounted to the path",
+				pvc, config.MountPath, container.Name, container.VolumeMounts[i].Name)
 		}
 	}
 	return nil
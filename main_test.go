@@ -21,26 +21,32 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	k8sclock "k8s.io/apimachinery/pkg/util/clock"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
 )
 
 type testCase struct {
 	requestBody      string
-	request          v1beta1.AdmissionReview
+	request          runtime.Object
 	expectStatus     int
-	expectedResponse v1beta1.AdmissionReview
+	expectedResponse runtime.Object
 	expectedError    string
 }
 
 var patchType = v1beta1.PatchTypeJSONPatch
+var patchTypeV1 = admissionv1.PatchTypeJSONPatch
+
+var v1beta1TypeMeta = metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"}
+var v1TypeMeta = metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
 
 var testCases []testCase = []testCase{
 	{
@@ -51,7 +57,8 @@ var testCases []testCase = []testCase{
 	},
 	{
 		// no annotation set, do nothing
-		request: v1beta1.AdmissionReview{
+		request: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Request: &v1beta1.AdmissionRequest{
 				UID:       "fake uuid",
 				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
@@ -62,7 +69,8 @@ var testCases []testCase = []testCase{
 			},
 		},
 		expectStatus: http.StatusOK,
-		expectedResponse: v1beta1.AdmissionReview{
+		expectedResponse: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Response: &v1beta1.AdmissionResponse{
 				UID:     "fake uuid",
 				Allowed: true,
@@ -71,7 +79,8 @@ var testCases []testCase = []testCase{
 	},
 	{
 		// invalid operation, we do nothing
-		request: v1beta1.AdmissionReview{
+		request: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Request: &v1beta1.AdmissionRequest{
 				UID:       "fake uuid",
 				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
@@ -82,11 +91,12 @@ var testCases []testCase = []testCase{
 			},
 		},
 		expectStatus:     http.StatusOK,
-		expectedResponse: v1beta1.AdmissionReview{},
+		expectedResponse: &v1beta1.AdmissionReview{TypeMeta: v1beta1TypeMeta},
 	},
 	{
 		// invalid object, we do nothing
-		request: v1beta1.AdmissionReview{
+		request: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Request: &v1beta1.AdmissionRequest{
 				UID:       "fake uuid",
 				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "services"},
@@ -97,11 +107,12 @@ var testCases []testCase = []testCase{
 			},
 		},
 		expectStatus:     http.StatusOK,
-		expectedResponse: v1beta1.AdmissionReview{},
+		expectedResponse: &v1beta1.AdmissionReview{TypeMeta: v1beta1TypeMeta},
 	},
 	{
 		// test pvc has been mounted successfully.
-		request: v1beta1.AdmissionReview{
+		request: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Request: &v1beta1.AdmissionRequest{
 				UID:       "fake uuid",
 				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
@@ -130,18 +141,20 @@ var testCases []testCase = []testCase{
 			},
 		},
 		expectStatus: http.StatusOK,
-		expectedResponse: v1beta1.AdmissionReview{
+		expectedResponse: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Response: &v1beta1.AdmissionResponse{
 				UID:       "fake uuid",
 				Allowed:   true,
 				PatchType: &patchType,
-				Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"pvc1-1033798960","subPath":"pod1/container1"}]},{"op":"add","path":"/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/volumes","value":[{"name":"pvc1-1033798960","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+				Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
 			},
 		},
 	},
 	{
 		// test pvc has been mounted successfully to init containers
-		request: v1beta1.AdmissionReview{
+		request: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Request: &v1beta1.AdmissionRequest{
 				UID:       "fake uuid",
 				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
@@ -175,25 +188,197 @@ var testCases []testCase = []testCase{
 			},
 		},
 		expectStatus: http.StatusOK,
-		expectedResponse: v1beta1.AdmissionReview{
+		expectedResponse: &v1beta1.AdmissionReview{
+			TypeMeta: v1beta1TypeMeta,
 			Response: &v1beta1.AdmissionResponse{
 				UID:       "fake uuid",
 				Allowed:   true,
 				PatchType: &patchType,
-				Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"pvc1-1033798960","subPath":"pod1/container1"}]},{"op":"add","path":"/spec/initContainers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"pvc1-1033798960","subPath":"pod1/container1"}]},{"op":"add","path":"/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/volumes","value":[{"name":"pvc1-1033798960","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+				Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/initContainers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/initContainers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+			},
+		},
+	},
+	{
+		// pod created with generateName, the pod name is expanded at runtime
+		request: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "fake uuid",
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object: runtime.RawExtension{
+					Object: &corev1.Pod{
+						TypeMeta: metav1.TypeMeta{
+							APIVersion: "v1",
+							Kind:       "Pod",
+						},
+						ObjectMeta: metav1.ObjectMeta{
+							GenerateName: "deployment1-7d4b9c-",
+							Annotations: map[string]string{
+								"coredump.fujitsu.com/pvcname": "pvc1",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Name: "container1",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		expectStatus: http.StatusOK,
+		expectedResponse: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Response: &admissionv1.AdmissionResponse{
+				UID:       "fake uuid",
+				Allowed:   true,
+				PatchType: &patchTypeV1,
+				Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+			},
+		},
+	},
+	{
+		// the container uses the pod name environment variable for something else
+		request: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "fake uuid",
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object: runtime.RawExtension{
+					Object: &corev1.Pod{
+						TypeMeta: metav1.TypeMeta{
+							APIVersion: "v1",
+							Kind:       "Pod",
+						},
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "pod1",
+							Annotations: map[string]string{
+								"coredump.fujitsu.com/pvcname": "pvc1",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Name: "container1",
+									Env:  []corev1.EnvVar{{Name: "COREDUMP_POD_NAME", Value: "foo"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		expectStatus: http.StatusOK,
+		expectedResponse: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Response: &admissionv1.AdmissionResponse{
+				UID: "fake uuid",
+				Result: &metav1.Status{
+					Message: `Failed to set environment variable "COREDUMP_POD_NAME" in container "container1", it is already set to another value`,
+					Code:    http.StatusBadRequest,
+				},
+			},
+		},
+	},
+	{
+		// AdmissionReview of an unknown version
+		requestBody:   `{"apiVersion":"admission.k8s.io/v1alpha1","kind":"AdmissionReview"}`,
+		expectStatus:  http.StatusBadRequest,
+		expectedError: "Failed to decode request body err",
+	},
+	{
+		// admission.k8s.io/v1: no annotation set, do nothing
+		request: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "fake uuid",
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object: runtime.RawExtension{
+					Object: &corev1.Pod{},
+				},
+			},
+		},
+		expectStatus: http.StatusOK,
+		expectedResponse: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Response: &admissionv1.AdmissionResponse{
+				UID:     "fake uuid",
+				Allowed: true,
+			},
+		},
+	},
+	{
+		// admission.k8s.io/v1: invalid operation, we do nothing
+		request: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "fake uuid",
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Update,
+				Object: runtime.RawExtension{
+					Object: &corev1.Pod{},
+				},
+			},
+		},
+		expectStatus:     http.StatusOK,
+		expectedResponse: &admissionv1.AdmissionReview{TypeMeta: v1TypeMeta},
+	},
+	{
+		// admission.k8s.io/v1: test pvc has been mounted successfully.
+		request: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "fake uuid",
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object: runtime.RawExtension{
+					Object: &corev1.Pod{
+						TypeMeta: metav1.TypeMeta{
+							APIVersion: "v1",
+							Kind:       "Pod",
+						},
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "pod1",
+							Annotations: map[string]string{
+								"coredump.fujitsu.com/pvcname": "pvc1",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Name: "container1",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		expectStatus: http.StatusOK,
+		expectedResponse: &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Response: &admissionv1.AdmissionResponse{
+				UID:       "fake uuid",
+				Allowed:   true,
+				PatchType: &patchTypeV1,
+				Patch:     []byte(`[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
 			},
 		},
 	},
 }
 
 func TestPodHandler(t *testing.T) {
-	clock = k8sclock.NewFakeClock(time.Unix(1033798960, 0))
 	for i, tc := range testCases {
 		var objJS []byte
 		var err error
 		if len(tc.requestBody) == 0 {
 			// prepare AdmissionReview
-			objJS, err = runtime.Encode(jsonSerializer, &tc.request)
+			objJS, err = runtime.Encode(jsonSerializer, tc.request)
 			if err != nil {
 				t.Fatalf("test[%d] fatal: %v", i, err)
 			}
@@ -212,9 +397,8 @@ func TestPodHandler(t *testing.T) {
 		assert.Equal(t, tc.expectStatus, resp.StatusCode, "Invalid http status code returned")
 		if resp.StatusCode == http.StatusOK {
 			// decode the body
-			response := v1beta1.AdmissionReview{}
 			deserializer := codecs.UniversalDeserializer()
-			_, _, err := deserializer.Decode(body, nil, &response)
+			response, _, err := deserializer.Decode(body, nil, nil)
 			fmt.Printf("%s\n", body)
 			require.Nil(t, err, "When response status is 200, the body should be an admission review")
 			assert.Equal(t, tc.expectedResponse, response, fmt.Sprintf("test %d: unexpected response", i))
@@ -224,3 +408,326 @@ func TestPodHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestMutatePodTwice(t *testing.T) {
+	pods := []*corev1.Pod{
+		{
+			// a plain pod
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod1",
+				Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+			},
+			Spec: corev1.PodSpec{
+				Containers:     []corev1.Container{{Name: "container1"}},
+				InitContainers: []corev1.Container{{Name: "init1"}},
+			},
+		},
+		{
+			// a pod with a node selector and volumes of its own
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod2",
+				Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:         "container1",
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				}},
+				Volumes: []corev1.Volume{{
+					Name:         "data",
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				}},
+				NodeSelector: map[string]string{"disk": "ssd"},
+			},
+		},
+		{
+			// a pod asking for compressed core files
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod3",
+				Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1", "coredump.fujitsu.com/compression": "zstd"},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "container1"}},
+			},
+		},
+		{
+			// a pod asking for an ephemeral volume
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod4",
+				Annotations: map[string]string{"coredump.fujitsu.com/storageclass": "fast"},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "container1"}},
+			},
+		},
+	}
+
+	for i, pod := range pods {
+		raw, err := runtime.Encode(jsonSerializer, pod)
+		require.Nil(t, err, "test %d: failed to encode pod", i)
+
+		var patches []string
+		for round := 0; round < 2; round++ {
+			response := mutatePod(admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+			require.NotNil(t, response, "test %d round %d: no response", i, round)
+			require.True(t, response.Allowed, "test %d round %d: pod rejected: %v", i, round, response.Result)
+			patches = append(patches, string(response.Patch))
+
+			patch, err := jsonpatch.DecodePatch(response.Patch)
+			require.Nil(t, err, "test %d round %d: invalid patch", i, round)
+			raw, err = patch.Apply(raw)
+			require.Nil(t, err, "test %d round %d: failed to apply patch", i, round)
+		}
+		assert.NotEqual(t, "[]", patches[0], "test %d: the first call should mutate the pod", i)
+		assert.Equal(t, "[]", patches[1], "test %d: the second call should not change the pod", i)
+	}
+}
+
+func TestMutatePodHostPath(t *testing.T) {
+	defaultConfig := config
+	defer func() { config = defaultConfig }()
+	config = defaultConfig.DeepCopy()
+	config.VolumeBackend = configv1alpha1.VolumeBackendHostPath
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod1",
+			Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "true"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}},
+		},
+	}
+	raw, err := runtime.Encode(jsonSerializer, pod)
+	require.Nil(t, err)
+
+	var patches []string
+	for round := 0; round < 2; round++ {
+		response := mutatePod(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Namespace: "default",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		require.NotNil(t, response, "round %d: no response", round)
+		require.True(t, response.Allowed, "round %d: pod rejected: %v", round, response.Result)
+		patches = append(patches, string(response.Patch))
+
+		patch, err := jsonpatch.DecodePatch(response.Patch)
+		require.Nil(t, err, "round %d: invalid patch", round)
+		raw, err = patch.Apply(raw)
+		require.Nil(t, err, "round %d: failed to apply patch", round)
+	}
+	assert.Equal(t, "[]", patches[1], "the second call should not change the pod")
+
+	mutated := &corev1.Pod{}
+	require.Nil(t, runtime.DecodeInto(codecs.UniversalDecoder(), raw, mutated))
+	directoryOrCreate := corev1.HostPathDirectoryOrCreate
+	assert.Equal(t, []corev1.Volume{{
+		Name: "coredump",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/coredump/default", Type: &directoryOrCreate},
+		},
+	}}, mutated.Spec.Volumes)
+	container := mutated.Spec.Containers[0]
+	assert.Equal(t, []corev1.EnvVar{{
+		Name: "COREDUMP_POD_UID",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.uid"},
+		},
+	}}, container.Env)
+	assert.Equal(t, []corev1.VolumeMount{{
+		Name:        "coredump",
+		MountPath:   "/var/coredump",
+		SubPathExpr: "$(COREDUMP_POD_UID)/app",
+	}}, container.VolumeMounts)
+}
+
+func TestMutatePodCompression(t *testing.T) {
+	testCases := []struct {
+		annotation     string
+		env            []corev1.EnvVar
+		expectedEnv    *corev1.EnvVar
+		expectedReason string
+	}{
+		{
+			annotation:  "gzip",
+			expectedEnv: &corev1.EnvVar{Name: "COREDUMP_COMPRESSION", Value: "gzip"},
+		},
+		{
+			annotation: "none",
+		},
+		{
+			annotation:     "bzip2",
+			expectedReason: "unknown compression",
+		},
+		{
+			annotation:     "gzip",
+			env:            []corev1.EnvVar{{Name: "COREDUMP_COMPRESSION", Value: "zstd"}},
+			expectedReason: "already set to another value",
+		},
+	}
+
+	for i, tc := range testCases {
+		pod := &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod1",
+				Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1", "coredump.fujitsu.com/compression": tc.annotation},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "container1", Env: tc.env}},
+			},
+		}
+		raw, err := runtime.Encode(jsonSerializer, pod)
+		require.Nil(t, err, "test %d: failed to encode pod", i)
+		response := mutatePod(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		require.NotNil(t, response, "test %d: no response", i)
+		if len(tc.expectedReason) != 0 {
+			assert.False(t, response.Allowed, "test %d: pod allowed", i)
+			assert.Contains(t, response.Result.Message, tc.expectedReason, "test %d", i)
+			continue
+		}
+		require.True(t, response.Allowed, "test %d: pod rejected: %v", i, response.Result)
+
+		patch, err := jsonpatch.DecodePatch(response.Patch)
+		require.Nil(t, err, "test %d: invalid patch", i)
+		raw, err = patch.Apply(raw)
+		require.Nil(t, err, "test %d: failed to apply patch", i)
+		mutated := &corev1.Pod{}
+		require.Nil(t, runtime.DecodeInto(codecs.UniversalDecoder(), raw, mutated), "test %d", i)
+		var env *corev1.EnvVar
+		for j := range mutated.Spec.Containers[0].Env {
+			if mutated.Spec.Containers[0].Env[j].Name == "COREDUMP_COMPRESSION" {
+				env = &mutated.Spec.Containers[0].Env[j]
+			}
+		}
+		assert.Equal(t, tc.expectedEnv, env, "test %d", i)
+	}
+}
+
+func TestMutatePodContainers(t *testing.T) {
+	conflicting := []corev1.VolumeMount{{Name: "other", MountPath: "/var/coredump"}}
+	testCases := []struct {
+		annotations     map[string]string
+		expectedMounted []bool
+		expectedReason  string
+	}{
+		{
+			annotations:    map[string]string{},
+			expectedReason: `volume "other" is already mounted`,
+		},
+		{
+			annotations:     map[string]string{"coredump.fujitsu.com/exclude-containers": "istio-proxy"},
+			expectedMounted: []bool{true, true, false},
+		},
+		{
+			annotations:     map[string]string{"coredump.fujitsu.com/containers": "app"},
+			expectedMounted: []bool{false, true, false},
+		},
+		{
+			annotations:    map[string]string{"coredump.fujitsu.com/containers": "app,Worker"},
+			expectedReason: "invalid container name",
+		},
+	}
+
+	for i, tc := range testCases {
+		annotations := map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"}
+		for k, v := range tc.annotations {
+			annotations[k] = v
+		}
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Annotations: annotations},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init"}},
+				Containers: []corev1.Container{
+					{Name: "app"},
+					{Name: "istio-proxy", VolumeMounts: conflicting},
+				},
+			},
+		}
+		raw, err := runtime.Encode(jsonSerializer, pod)
+		require.Nil(t, err, "test %d: failed to encode pod", i)
+		response := mutatePod(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		require.NotNil(t, response, "test %d: no response", i)
+		if len(tc.expectedReason) != 0 {
+			assert.False(t, response.Allowed, "test %d: pod allowed", i)
+			assert.Contains(t, response.Result.Message, tc.expectedReason, "test %d", i)
+			continue
+		}
+		require.True(t, response.Allowed, "test %d: pod rejected: %v", i, response.Result)
+
+		patch, err := jsonpatch.DecodePatch(response.Patch)
+		require.Nil(t, err, "test %d: invalid patch", i)
+		raw, err = patch.Apply(raw)
+		require.Nil(t, err, "test %d: failed to apply patch", i)
+		mutated := &corev1.Pod{}
+		require.Nil(t, runtime.DecodeInto(codecs.UniversalDecoder(), raw, mutated), "test %d", i)
+		containers := append(mutated.Spec.InitContainers, mutated.Spec.Containers...)
+		var mounted []bool
+		for _, container := range containers {
+			m := false
+			for _, mount := range container.VolumeMounts {
+				m = m || mount.Name == "coredump"
+			}
+			mounted = append(mounted, m)
+		}
+		assert.Equal(t, tc.expectedMounted, mounted, "test %d", i)
+		assert.Equal(t, conflicting, containers[2].VolumeMounts, "test %d: the skipped container is changed", i)
+	}
+}
+
+func TestMutateEphemeralContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod1",
+			Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+		},
+		Spec: corev1.PodSpec{
+			Containers:          []corev1.Container{{Name: "container1"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}}},
+		},
+	}
+	raw, err := runtime.Encode(jsonSerializer, pod)
+	require.Nil(t, err)
+
+	// the webhook was registered with the ephemeral containers by an older version
+	response := mutate(admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			Resource:    metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+			SubResource: "ephemeralcontainers",
+			Operation:   admissionv1.Update,
+			Object:      runtime.RawExtension{Raw: raw},
+		},
+	})
+	require.NotNil(t, response)
+	assert.True(t, response.Allowed, "the ephemeral containers should be allowed: %v", response.Result)
+	assert.Empty(t, response.Patch, "the ephemeral containers should be left alone")
+}
@@ -0,0 +1,146 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// reasons of rejected pods, used as the reason label of rejectedPods
+const (
+	reasonMountConflict      = "mount_conflict"
+	reasonSchedulingConflict = "scheduling_conflict"
+	reasonInvalidAnnotation  = "invalid_annotation"
+	reasonClaimNotFound      = "claim_not_found"
+	reasonClaimNotBound      = "claim_not_bound"
+	reasonClaimNotRWX        = "claim_not_rwx"
+)
+
+var (
+	admissionRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coredump_detector",
+			Name:      "admission_requests_total",
+			Help:      "Number of admission requests by webhook, operation and outcome (mutated, allowed, rejected, error or ignored).",
+		},
+		[]string{"webhook", "operation", "outcome"},
+	)
+	admissionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "coredump_detector",
+			Name:      "admission_duration_seconds",
+			Help:      "Time spent handling an admission request by webhook.",
+			Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		},
+		[]string{"webhook"},
+	)
+	decodeFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "coredump_detector",
+			Name:      "decode_failures_total",
+			Help:      "Number of request bodies which are not a supported AdmissionReview.",
+		},
+	)
+	rejectedPods = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "coredump_detector",
+			Name:      "rejected_pods_total",
+			Help:      "Number of pods and workloads rejected by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+// registry holds the metrics of coredump-detector served on /metrics.
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		admissionRequests,
+		admissionDuration,
+		decodeFailures,
+		rejectedPods,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ready is set once the webhook server is listening.
+var ready int32
+
+// instrument records the outcome and the duration of every call to admit.
+func instrument(webhook string, admit admitFunc) admitFunc {
+	return func(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+		start := time.Now()
+		response := admit(ar)
+		admissionDuration.WithLabelValues(webhook).Observe(time.Since(start).Seconds())
+
+		operation := ""
+		if ar.Request != nil {
+			operation = string(ar.Request.Operation)
+		}
+		admissionRequests.WithLabelValues(webhook, operation, outcome(response)).Inc()
+		return response
+	}
+}
+
+// outcome tells what an admission response does to the object.
+func outcome(response *admissionv1.AdmissionResponse) string {
+	switch {
+	case response == nil:
+		return "ignored"
+	case response.Allowed && len(response.Patch) != 0 && !bytes.Equal(response.Patch, []byte("[]")):
+		return "mutated"
+	case response.Allowed:
+		return "allowed"
+	case response.Result != nil && response.Result.Code >= http.StatusInternalServerError:
+		return "error"
+	default:
+		return "rejected"
+	}
+}
+
+// rejectAdmissionResponse rejects the object for reason and counts it in rejectedPods.
+func rejectAdmissionResponse(err error, code int32, reason string) *admissionv1.AdmissionResponse {
+	rejectedPods.WithLabelValues(reason).Inc()
+	return toAdmissionResponse(err, code)
+}
+
+// newMonitoringMux returns the handler of the plain http port, serving
+// /healthz, /readyz and /metrics.
+func newMonitoringMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("webhook server is not listening yet"))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return mux
+}
@@ -0,0 +1,112 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	body, err := ioutil.ReadAll(w.Result().Body)
+	require.Nil(t, err)
+	return w.Result().StatusCode, string(body)
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	defer atomic.StoreInt32(&ready, 0)
+	mux := newMonitoringMux()
+
+	code, _ := get(t, mux, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get(t, mux, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	atomic.StoreInt32(&ready, 1)
+	code, _ = get(t, mux, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestMetrics(t *testing.T) {
+	post := func(body []byte) {
+		request := httptest.NewRequest("POST", "http://example.com/foo", bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		podHandler(httptest.NewRecorder(), request)
+	}
+
+	// a decode failure
+	post([]byte("invalid request body"))
+
+	// a mutated pod and a rejected pod
+	pods := []*corev1.Pod{
+		{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod1",
+				Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "container1"}}},
+		},
+		{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod2",
+				Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:         "container1",
+				VolumeMounts: []corev1.VolumeMount{{Name: "other", MountPath: "/var/coredump"}},
+			}}},
+		},
+	}
+	for _, pod := range pods {
+		body, err := runtime.Encode(jsonSerializer, &admissionv1.AdmissionReview{
+			TypeMeta: v1TypeMeta,
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "fake uuid",
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Object: pod},
+			},
+		})
+		require.Nil(t, err)
+		post(body)
+	}
+
+	code, metrics := get(t, newMonitoringMux(), "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	for _, expected := range []string{
+		`coredump_detector_admission_requests_total{operation="CREATE",outcome="mutated",webhook="mutating"}`,
+		`coredump_detector_admission_requests_total{operation="CREATE",outcome="rejected",webhook="mutating"}`,
+		`coredump_detector_admission_duration_seconds_count{webhook="mutating"}`,
+		`coredump_detector_decode_failures_total`,
+		`coredump_detector_rejected_pods_total{reason="mount_conflict"}`,
+	} {
+		assert.Contains(t, metrics, expected)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+// nodeAgentOptions contains the options of `coredump-detector node-agent`
+type nodeAgentOptions struct {
+	NodeName    string
+	ProcRoot    string
+	CorePattern string
+	CoreUsesPID bool
+	Interval    time.Duration
+	Kubeconfig  string
+	ConfigFile  string
+	// HostPathRoot is where the directory of the HostPath volume backend is mounted.
+	HostPathRoot string
+}
+
+func (o *nodeAgentOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.NodeName, "node-name", o.NodeName, ""+
+		"Name of the node the agent runs on. Defaults to the NODE_NAME environment variable.")
+	fs.StringVar(&o.ProcRoot, "proc-root", o.ProcRoot, ""+
+		"Where the proc filesystem of the node is mounted, e.g. /host/proc when the agent runs in a container.")
+	fs.StringVar(&o.CorePattern, "core-pattern", o.CorePattern, ""+
+		"The kernel.core_pattern to set. Defaults to core_%e_%t in the mount path of the configuration.")
+	fs.BoolVar(&o.CoreUsesPID, "core-uses-pid", o.CoreUsesPID, "The kernel.core_uses_pid to set.")
+	fs.DurationVar(&o.Interval, "interval", o.Interval, "How often core_pattern and core_uses_pid are re-checked.")
+	fs.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, ""+
+		"Path to a kubeconfig file used to talk to kube-apiserver. The in-cluster config is used when it is empty.")
+	fs.StringVar(&o.ConfigFile, "config", o.ConfigFile, ""+
+		"Path to the Configuration file of the webhook. Its node selector is the label set on the node.")
+	fs.StringVar(&o.HostPathRoot, "host-path-root", o.HostPathRoot, ""+
+		"Where the host path directory of the configuration is mounted, e.g. /host/var/lib/coredump when the agent runs in a container. "+
+		"Defaults to the host path directory itself. Only used with the HostPath volume backend.")
+}
+
+// nodeAgent keeps the core dump settings of a node, and labels the node with the
+// node selector of the configuration while the settings are in place.
+type nodeAgent struct {
+	client      kubernetes.Interface
+	nodeName    string
+	procRoot    string
+	corePattern string
+	coreUsesPID string
+	labels      map[string]string
+	// hostPath looks after the directories of the HostPath volume backend, it is nil
+	// with the other backends.
+	hostPath *hostPathJanitor
+}
+
+// sync writes core_pattern and core_uses_pid when they differ from the expected
+// values, then adds the labels to the node if both of them read back as expected
+// and removes the labels otherwise. At last the host path directories are synced.
+func (a *nodeAgent) sync() error {
+	ready := true
+	for name, value := range map[string]string{
+		"core_pattern":  a.corePattern,
+		"core_uses_pid": a.coreUsesPID,
+	} {
+		if err := a.ensureSysctl(name, value); err != nil {
+			glog.Errorf("node %s does not support coredump: %v", a.nodeName, err)
+			ready = false
+		}
+	}
+	err := a.labelNode(ready)
+	if a.hostPath != nil {
+		if hostPathErr := a.hostPath.sync(time.Now()); err == nil {
+			err = hostPathErr
+		}
+	}
+	return err
+}
+
+// ensureSysctl sets kernel.<name> under the proc root to value and reads it back.
+func (a *nodeAgent) ensureSysctl(name, value string) error {
+	path := filepath.Join(a.procRoot, "sys", "kernel", name)
+	current, err := readSysctl(path)
+	if err != nil {
+		return err
+	}
+	if current == value {
+		return nil
+	}
+	glog.Infof("setting kernel.%s to %q, it was %q", name, value, current)
+	// files in /proc can't be created, so O_CREATE is left out on purpose
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if current, err = readSysctl(path); err != nil {
+		return err
+	}
+	if current != value {
+		return fmt.Errorf("kernel.%s is %q after setting it to %q", name, current, value)
+	}
+	return nil
+}
+
+func readSysctl(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// labelNode adds the labels to the node when ready is true and removes them otherwise.
+// The node is only updated when its labels change.
+func (a *nodeAgent) labelNode(ready bool) error {
+	node, err := a.client.CoreV1().Nodes().Get(context.TODO(), a.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	node = node.DeepCopy()
+	changed := false
+	for k, v := range a.labels {
+		current, ok := node.Labels[k]
+		switch {
+		case ready && current != v:
+			if node.Labels == nil {
+				node.Labels = map[string]string{}
+			}
+			node.Labels[k] = v
+			changed = true
+		case !ready && ok && current == v:
+			delete(node.Labels, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	glog.Infof("updating the labels of node %s to %v", a.nodeName, node.Labels)
+	_, err = a.client.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{})
+	return err
+}
+
+// runNodeAgent implements `coredump-detector node-agent`.
+func runNodeAgent(args []string) error {
+	o := &nodeAgentOptions{
+		NodeName:    os.Getenv("NODE_NAME"),
+		ProcRoot:    "/proc",
+		CoreUsesPID: true,
+		Interval:    time.Minute,
+	}
+	fs := pflag.NewFlagSet("node-agent", pflag.ContinueOnError)
+	o.addFlags(fs)
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(o.NodeName) == 0 {
+		return fmt.Errorf("--node-name or the NODE_NAME environment variable is required")
+	}
+
+	c := config
+	if len(o.ConfigFile) != 0 {
+		var err error
+		if c, err = loadConfig(o.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if len(o.CorePattern) == 0 {
+		o.CorePattern = filepath.Join(c.MountPath, "core_%e_%t")
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", o.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	agent := &nodeAgent{
+		client:      client,
+		nodeName:    o.NodeName,
+		procRoot:    o.ProcRoot,
+		corePattern: o.CorePattern,
+		coreUsesPID: "0",
+		labels:      c.NodeSelector,
+	}
+	if o.CoreUsesPID {
+		agent.coreUsesPID = "1"
+	}
+	if c.VolumeBackend == configv1alpha1.VolumeBackendHostPath {
+		root := o.HostPathRoot
+		if len(root) == 0 {
+			root = hostPathDir(c)
+		}
+		agent.hostPath = newHostPathJanitor(client, o.NodeName, root, c)
+	}
+	wait.Until(func() {
+		if err := agent.sync(); err != nil {
+			glog.Errorf("failed to sync node %s: %v", o.NodeName, err)
+		}
+	}, o.Interval, wait.NeverStop)
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeProc creates a proc root with the given files in sys/kernel.
+func fakeProc(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "sys", "kernel"), 0755))
+	for name, content := range files {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sys", "kernel", name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestNodeAgentSync(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]string
+		labels         map[string]string
+		expectedLabels map[string]string
+		expectedFiles  map[string]string
+	}{
+		{
+			name:           "set up the node",
+			files:          map[string]string{"core_pattern": "core\n", "core_uses_pid": "0\n"},
+			labels:         map[string]string{"kubernetes.io/hostname": "node1"},
+			expectedLabels: map[string]string{"kubernetes.io/hostname": "node1", "coredump": "true"},
+			expectedFiles:  map[string]string{"core_pattern": "/var/coredump/core_%e_%t\n", "core_uses_pid": "1\n"},
+		},
+		{
+			name:           "already set up",
+			files:          map[string]string{"core_pattern": "/var/coredump/core_%e_%t\n", "core_uses_pid": "1\n"},
+			labels:         map[string]string{"coredump": "true"},
+			expectedLabels: map[string]string{"coredump": "true"},
+			expectedFiles:  map[string]string{"core_pattern": "/var/coredump/core_%e_%t\n", "core_uses_pid": "1\n"},
+		},
+		{
+			name:           "core_uses_pid is missing",
+			files:          map[string]string{"core_pattern": "core\n"},
+			labels:         map[string]string{"kubernetes.io/hostname": "node1", "coredump": "true"},
+			expectedLabels: map[string]string{"kubernetes.io/hostname": "node1"},
+			expectedFiles:  map[string]string{"core_pattern": "/var/coredump/core_%e_%t\n"},
+		},
+		{
+			name:           "label set to another value is kept",
+			files:          map[string]string{},
+			labels:         map[string]string{"coredump": "false"},
+			expectedLabels: map[string]string{"coredump": "false"},
+			expectedFiles:  map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			procRoot := fakeProc(t, test.files)
+			defer os.RemoveAll(procRoot)
+			// NewClientset fails the writes of the vendored API types, whose package paths
+			// don't match their OpenAPI names, so the writes are tracked without managed fields.
+			client := fake.NewSimpleClientset(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: test.labels},
+			})
+			agent := &nodeAgent{
+				client:      client,
+				nodeName:    "node1",
+				procRoot:    procRoot,
+				corePattern: "/var/coredump/core_%e_%t",
+				coreUsesPID: "1",
+				labels:      map[string]string{"coredump": "true"},
+			}
+			require.Nil(t, agent.sync())
+
+			node, err := client.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+			require.Nil(t, err)
+			assert.Equal(t, test.expectedLabels, node.Labels)
+			for name, content := range test.expectedFiles {
+				data, err := ioutil.ReadFile(filepath.Join(procRoot, "sys", "kernel", name))
+				require.Nil(t, err)
+				assert.Equal(t, content, string(data), name)
+			}
+			_, err = os.Stat(filepath.Join(procRoot, "sys", "kernel", "core_uses_pid"))
+			_, expected := test.expectedFiles["core_uses_pid"]
+			assert.Equal(t, expected, err == nil, "core_uses_pid should not be created")
+		})
+	}
+}
+
+func TestNodeAgentSyncNodeNotFound(t *testing.T) {
+	procRoot := fakeProc(t, map[string]string{"core_pattern": "core\n", "core_uses_pid": "0\n"})
+	defer os.RemoveAll(procRoot)
+	agent := &nodeAgent{
+		client:      fake.NewClientset(),
+		nodeName:    "node1",
+		procRoot:    procRoot,
+		corePattern: "/var/coredump/core_%e_%t",
+		coreUsesPID: "1",
+		labels:      map[string]string{"coredump": "true"},
+	}
+	assert.NotNil(t, agent.sync())
+}
@@ -0,0 +1,37 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func addDefaultingFuncs(scheme *runtime.Scheme) error {
+	scheme.AddTypeDefaultingFunc(&Configuration{}, func(obj interface{}) { SetDefaults_Configuration(obj.(*Configuration)) })
+	return nil
+}
+
+// SetDefaults_Configuration fills in the fields left empty in the config file.
+func SetDefaults_Configuration(obj *Configuration) {
+	if len(obj.AnnotationKey) == 0 {
+		obj.AnnotationKey = "coredump.fujitsu.com/pvcname"
+	}
+	if len(obj.MountPath) == 0 {
+		obj.MountPath = "/var/coredump"
+	}
+	if len(obj.NodeSelector) == 0 {
+		obj.NodeSelector = map[string]string{"coredump": "true"}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Configuration holds the settings of the coredump-detector webhook.
+type Configuration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// AnnotationKey is the pod annotation naming the persistent volume claim
+	// which the core files are saved into. With the HostPath VolumeBackend its
+	// value is not used.
+	// Defaults to "coredump.fujitsu.com/pvcname".
+	AnnotationKey string `json:"annotationKey,omitempty"`
+
+	// VolumeBackend is the volume the pods with AnnotationKey get.
+	// Defaults to PersistentVolumeClaim.
+	VolumeBackend VolumeBackend `json:"volumeBackend,omitempty"`
+
+	// HostPath configures the HostPath VolumeBackend.
+	HostPath HostPathBackend `json:"hostPath,omitempty"`
+
+	// MountPath is the directory of every container the claim is mounted to.
+	// It should match the directory in the core_pattern of the nodes.
+	// Defaults to "/var/coredump".
+	MountPath string `json:"mountPath,omitempty"`
+
+	// NodeSelector is merged into the node selector of the mutated pods, so that
+	// they are scheduled to the nodes that support coredump.
+	// Defaults to {"coredump": "true"}.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// NodePlacement is how NodeSelector is put into the mutated pods.
+	// Defaults to NodeSelector.
+	NodePlacement NodePlacement `json:"nodePlacement,omitempty"`
+
+	// Tolerations are added to the mutated pods, e.g. to let them run on the
+	// tainted nodes dedicated to coredump.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// EphemeralVolumeSize is the size of the ephemeral volumes created for the pods
+	// which ask for a storage class instead of naming a claim.
+	// Defaults to 10Gi.
+	EphemeralVolumeSize *resource.Quantity `json:"ephemeralVolumeSize,omitempty"`
+
+	// Retention is the default retention policy of `coredump-detector cleanup`.
+	// Pods may override it with annotations.
+	// Defaults to keep everything.
+	Retention RetentionPolicy `json:"retention,omitempty"`
+
+	// CoreLimit limits the cores `coredump-detector handle` saves for every container,
+	// so that a crash looping container doesn't fill the claim.
+	// Defaults to no limit.
+	CoreLimit CoreLimit `json:"coreLimit,omitempty"`
+}
+
+// VolumeBackend is the volume the core files of the pods are saved into.
+type VolumeBackend string
+
+const (
+	// VolumeBackendPersistentVolumeClaim mounts the persistent volume claim named in
+	// the annotation, which is shared by the pods of a namespace.
+	VolumeBackendPersistentVolumeClaim VolumeBackend = "PersistentVolumeClaim"
+	// VolumeBackendHostPath mounts a directory of the node for every pod, so that
+	// no storage class supporting ReadWriteMany is needed.
+	VolumeBackendHostPath VolumeBackend = "HostPath"
+)
+
+// HostPathBackend configures the directories of the nodes the core files are saved
+// into with the HostPath VolumeBackend. `coredump-detector node-agent` changes
+// their ownership and enforces the quotas.
+type HostPathBackend struct {
+	// Path is the directory of the nodes holding `<namespace>/<pod uid>/<container name>`.
+	// Defaults to "/var/lib/coredump".
+	Path string `json:"path,omitempty"`
+
+	// MaxBytesPerPod is the total size of the core files kept for every pod. The
+	// oldest ones beyond it are deleted.
+	// Defaults to 10Gi.
+	MaxBytesPerPod *resource.Quantity `json:"maxBytesPerPod,omitempty"`
+
+	// KeepDeletedPods is how long the core files of the pods which are gone are kept.
+	// Defaults to 24h.
+	KeepDeletedPods *metav1.Duration `json:"keepDeletedPods,omitempty"`
+}
+
+// NodePlacement is how the mutated pods are kept on the nodes that support coredump.
+type NodePlacement string
+
+const (
+	// NodePlacementNodeSelector merges the NodeSelector into the node selector of the pods.
+	NodePlacementNodeSelector NodePlacement = "NodeSelector"
+	// NodePlacementRequired merges the NodeSelector into every term of the required
+	// node affinity of the pods.
+	NodePlacementRequired NodePlacement = "RequiredNodeAffinity"
+	// NodePlacementPreferred adds a preferred node affinity term of the NodeSelector
+	// to the pods, so that they still run when no such node is available.
+	NodePlacementPreferred NodePlacement = "PreferredNodeAffinity"
+)
+
+// CoreLimit limits the cores saved for every container in a crash storm. Only
+// the metadata of the cores beyond the limit is saved.
+type CoreLimit struct {
+	// MaxCores is the number of cores saved for every container in Interval.
+	// Unlimited when not set.
+	MaxCores *int32 `json:"maxCores,omitempty"`
+
+	// Interval is the sliding window the cores are counted in.
+	// Defaults to 1h.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// KeepLast is the number of the latest cores beyond MaxCores which are saved too.
+	// The older ones are reduced to their metadata as newer ones come, so that
+	// the first and the last cores of a crash storm are kept.
+	// Defaults to 0.
+	KeepLast *int32 `json:"keepLast,omitempty"`
+}
+
+// RetentionPolicy limits the core files kept in a claim. The oldest files are
+// deleted first. A limit which is not set is unlimited.
+type RetentionPolicy struct {
+	// MaxAge is how long a core file is kept.
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// MaxCount is the number of core files kept for every container.
+	MaxCount *int32 `json:"maxCount,omitempty"`
+
+	// MaxBytesPerContainer is the total size of the core files kept for every container.
+	MaxBytesPerContainer *resource.Quantity `json:"maxBytesPerContainer,omitempty"`
+
+	// MaxBytesPerPod is the total size of the core files kept for every pod.
+	MaxBytesPerPod *resource.Quantity `json:"maxBytesPerPod,omitempty"`
+
+	// MaxBytesPerNamespace is the total size of the core files kept in the claim
+	// of a namespace. It can't be overridden by pods.
+	MaxBytesPerNamespace *resource.Quantity `json:"maxBytesPerNamespace,omitempty"`
+}
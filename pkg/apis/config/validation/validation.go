@@ -0,0 +1,178 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validation validates the coredump-detector configuration.
+package validation
+
+import (
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+// ValidateConfiguration returns all the errors found in config.
+func ValidateConfiguration(config *v1alpha1.Configuration) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	for _, msg := range validation.IsQualifiedName(config.AnnotationKey) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("annotationKey"), config.AnnotationKey, msg))
+	}
+
+	allErrs = append(allErrs, validateDirectory(config.MountPath, field.NewPath("mountPath"))...)
+	switch config.VolumeBackend {
+	case "", v1alpha1.VolumeBackendPersistentVolumeClaim, v1alpha1.VolumeBackendHostPath:
+	default:
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("volumeBackend"), config.VolumeBackend,
+			[]string{string(v1alpha1.VolumeBackendPersistentVolumeClaim), string(v1alpha1.VolumeBackendHostPath)}))
+	}
+	allErrs = append(allErrs, ValidateHostPathBackend(&config.HostPath, field.NewPath("hostPath"))...)
+
+	nodeSelectorField := field.NewPath("nodeSelector")
+	for k, v := range config.NodeSelector {
+		for _, msg := range validation.IsQualifiedName(k) {
+			allErrs = append(allErrs, field.Invalid(nodeSelectorField, k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			allErrs = append(allErrs, field.Invalid(nodeSelectorField.Key(k), v, msg))
+		}
+	}
+	switch config.NodePlacement {
+	case "", v1alpha1.NodePlacementNodeSelector, v1alpha1.NodePlacementRequired, v1alpha1.NodePlacementPreferred:
+	default:
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("nodePlacement"), config.NodePlacement,
+			[]string{string(v1alpha1.NodePlacementNodeSelector), string(v1alpha1.NodePlacementRequired), string(v1alpha1.NodePlacementPreferred)}))
+	}
+	allErrs = append(allErrs, ValidateTolerations(config.Tolerations, field.NewPath("tolerations"))...)
+	if config.EphemeralVolumeSize != nil && config.EphemeralVolumeSize.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("ephemeralVolumeSize"), config.EphemeralVolumeSize.String(), "must be greater than 0"))
+	}
+	allErrs = append(allErrs, ValidateRetentionPolicy(&config.Retention, field.NewPath("retention"))...)
+	allErrs = append(allErrs, ValidateCoreLimit(&config.CoreLimit, field.NewPath("coreLimit"))...)
+	return allErrs
+}
+
+// validateDirectory ensures that dir is a clean absolute path other than the root directory.
+func validateDirectory(dir string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if !path.IsAbs(dir) {
+		allErrs = append(allErrs, field.Invalid(fldPath, dir, "must be an absolute path"))
+	} else if path.Clean(dir) != dir {
+		allErrs = append(allErrs, field.Invalid(fldPath, dir, "must be a clean path"))
+	} else if dir == "/" {
+		allErrs = append(allErrs, field.Invalid(fldPath, dir, "must not be the root directory"))
+	}
+	return allErrs
+}
+
+// ValidateHostPathBackend returns all the errors found in backend.
+func ValidateHostPathBackend(backend *v1alpha1.HostPathBackend, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if len(backend.Path) != 0 {
+		allErrs = append(allErrs, validateDirectory(backend.Path, fldPath.Child("path"))...)
+	}
+	if backend.MaxBytesPerPod != nil && backend.MaxBytesPerPod.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxBytesPerPod"), backend.MaxBytesPerPod.String(), "must be greater than 0"))
+	}
+	if backend.KeepDeletedPods != nil && backend.KeepDeletedPods.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("keepDeletedPods"), backend.KeepDeletedPods.Duration.String(), "must not be negative"))
+	}
+	return allErrs
+}
+
+// ValidateTolerations returns all the errors found in tolerations, following the
+// rules the kube-apiserver checks the tolerations of pods with.
+func ValidateTolerations(tolerations []corev1.Toleration, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, toleration := range tolerations {
+		idxPath := fldPath.Index(i)
+		if len(toleration.Key) != 0 {
+			for _, msg := range validation.IsQualifiedName(toleration.Key) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("key"), toleration.Key, msg))
+			}
+		} else if toleration.Operator != corev1.TolerationOpExists {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("operator"), toleration.Operator, "operator must be Exists when key is empty"))
+		}
+		switch toleration.Operator {
+		case "", corev1.TolerationOpEqual:
+			for _, msg := range validation.IsValidLabelValue(toleration.Value) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("value"), toleration.Value, msg))
+			}
+		case corev1.TolerationOpExists:
+			if len(toleration.Value) != 0 {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("value"), toleration.Value, "value must be empty when operator is Exists"))
+			}
+		default:
+			allErrs = append(allErrs, field.NotSupported(idxPath.Child("operator"), toleration.Operator,
+				[]string{string(corev1.TolerationOpEqual), string(corev1.TolerationOpExists)}))
+		}
+		switch toleration.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			allErrs = append(allErrs, field.NotSupported(idxPath.Child("effect"), toleration.Effect,
+				[]string{string(corev1.TaintEffectNoSchedule), string(corev1.TaintEffectPreferNoSchedule), string(corev1.TaintEffectNoExecute)}))
+		}
+		if toleration.TolerationSeconds != nil && toleration.Effect != corev1.TaintEffectNoExecute {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("effect"), toleration.Effect, "effect must be NoExecute when tolerationSeconds is set"))
+		}
+	}
+	return allErrs
+}
+
+// ValidateCoreLimit returns all the errors found in limit.
+func ValidateCoreLimit(limit *v1alpha1.CoreLimit, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if limit.MaxCores != nil && *limit.MaxCores <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxCores"), *limit.MaxCores, "must be greater than 0"))
+	}
+	if limit.Interval != nil && limit.Interval.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("interval"), limit.Interval.Duration.String(), "must be greater than 0"))
+	}
+	if limit.KeepLast != nil {
+		if *limit.KeepLast < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("keepLast"), *limit.KeepLast, "must be greater than or equal to 0"))
+		} else if *limit.KeepLast > 0 && limit.MaxCores == nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("keepLast"), "requires maxCores"))
+		}
+	}
+	return allErrs
+}
+
+// ValidateRetentionPolicy returns all the errors found in policy.
+func ValidateRetentionPolicy(policy *v1alpha1.RetentionPolicy, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if policy.MaxAge != nil && policy.MaxAge.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxAge"), policy.MaxAge.Duration.String(), "must be greater than 0"))
+	}
+	if policy.MaxCount != nil && *policy.MaxCount <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxCount"), *policy.MaxCount, "must be greater than 0"))
+	}
+	for _, q := range []struct {
+		name     string
+		quantity *resource.Quantity
+	}{
+		{"maxBytesPerContainer", policy.MaxBytesPerContainer},
+		{"maxBytesPerPod", policy.MaxBytesPerPod},
+		{"maxBytesPerNamespace", policy.MaxBytesPerNamespace},
+	} {
+		if q.quantity != nil && q.quantity.Sign() <= 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(q.name), q.quantity.String(), "must be greater than 0"))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,177 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+func TestValidateConfiguration(t *testing.T) {
+	maxCount, zero, negative := int32(10), int32(0), int32(-1)
+	seconds := int64(300)
+	maxBytes, zeroBytes, negativeBytes := resource.MustParse("1Gi"), resource.MustParse("0"), resource.MustParse("-1Mi")
+	testCases := []struct {
+		config       v1alpha1.Configuration
+		expectedErrs []string
+	}{
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "example.com/claim",
+				MountPath:     "/cores",
+				NodeSelector:  map[string]string{"example.com/coredump": "enabled"},
+			},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "example.com/claim/name",
+				MountPath:     "cores",
+				NodeSelector:  map[string]string{"coredump": "not valid"},
+			},
+			expectedErrs: []string{"annotationKey", "mountPath", "nodeSelector[coredump]"},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/var/../cores",
+				NodeSelector:  map[string]string{"a/b/c": "true"},
+			},
+			expectedErrs: []string{"mountPath", "nodeSelector"},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				Retention: v1alpha1.RetentionPolicy{
+					MaxAge:               &metav1.Duration{Duration: 72 * time.Hour},
+					MaxCount:             &maxCount,
+					MaxBytesPerContainer: &maxBytes,
+				},
+			},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				Retention: v1alpha1.RetentionPolicy{
+					MaxAge:               &metav1.Duration{Duration: -time.Hour},
+					MaxCount:             &zero,
+					MaxBytesPerPod:       &zeroBytes,
+					MaxBytesPerNamespace: &negativeBytes,
+				},
+			},
+			expectedErrs: []string{"retention.maxAge", "retention.maxCount", "retention.maxBytesPerPod", "retention.maxBytesPerNamespace"},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				CoreLimit: v1alpha1.CoreLimit{
+					MaxCores: &maxCount,
+					Interval: &metav1.Duration{Duration: time.Hour},
+					KeepLast: &maxCount,
+				},
+			},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				CoreLimit: v1alpha1.CoreLimit{
+					MaxCores: &zero,
+					Interval: &metav1.Duration{},
+					KeepLast: &negative,
+				},
+			},
+			expectedErrs: []string{"coreLimit.maxCores", "coreLimit.interval", "coreLimit.keepLast"},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				CoreLimit:     v1alpha1.CoreLimit{KeepLast: &maxCount},
+			},
+			expectedErrs: []string{"coreLimit.keepLast"},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				NodePlacement: v1alpha1.NodePlacementPreferred,
+				Tolerations: []corev1.Toleration{
+					{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "coredump", Effect: corev1.TaintEffectNoSchedule},
+					{Operator: corev1.TolerationOpExists},
+					{Key: "node.kubernetes.io/unreachable", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &seconds},
+				},
+			},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey:       "claim",
+				MountPath:           "/cores",
+				NodePlacement:       "Anywhere",
+				EphemeralVolumeSize: &zeroBytes,
+				Tolerations: []corev1.Toleration{
+					{Value: "coredump"},
+					{Key: "dedicated", Operator: corev1.TolerationOpExists, Value: "coredump"},
+					{Key: "dedicated", Operator: "In", Effect: "NoWay"},
+					{Key: "dedicated", Effect: corev1.TaintEffectNoSchedule, TolerationSeconds: &seconds},
+				},
+			},
+			expectedErrs: []string{"nodePlacement", "tolerations[0].operator", "tolerations[1].value", "tolerations[2].operator", "tolerations[2].effect", "tolerations[3].effect", "ephemeralVolumeSize"},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				VolumeBackend: v1alpha1.VolumeBackendHostPath,
+				HostPath: v1alpha1.HostPathBackend{
+					Path:            "/var/lib/coredump",
+					MaxBytesPerPod:  &maxBytes,
+					KeepDeletedPods: &metav1.Duration{},
+				},
+			},
+		},
+		{
+			config: v1alpha1.Configuration{
+				AnnotationKey: "claim",
+				MountPath:     "/cores",
+				VolumeBackend: "EmptyDir",
+				HostPath: v1alpha1.HostPathBackend{
+					Path:            "var/lib/coredump",
+					MaxBytesPerPod:  &negativeBytes,
+					KeepDeletedPods: &metav1.Duration{Duration: -time.Hour},
+				},
+			},
+			expectedErrs: []string{"volumeBackend", "hostPath.path", "hostPath.maxBytesPerPod", "hostPath.keepDeletedPods"},
+		},
+	}
+
+	for i, tc := range testCases {
+		errs := ValidateConfiguration(&tc.config)
+		var fields []string
+		for _, err := range errs {
+			fields = append(fields, err.Field)
+		}
+		assert.Equal(t, tc.expectedErrs, fields, "test %d: unexpected errors %v", i, errs)
+	}
+}
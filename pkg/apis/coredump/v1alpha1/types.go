@@ -0,0 +1,97 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CoreDump records a core file saved for a container. It is created in the
+// namespace of the pod, so whoever may read CoreDumps there sees the crashes.
+type CoreDump struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CoreDumpSpec `json:"spec"`
+}
+
+// CoreDumpSpec describes the crashed process and where its core file is saved.
+type CoreDumpSpec struct {
+	// PodName is the name of the pod the process ran in.
+	PodName string `json:"podName"`
+
+	// PodUID is the uid of the pod the process ran in.
+	PodUID types.UID `json:"podUID"`
+
+	// ContainerName is the name of the container the process ran in.
+	// It is empty when the container can't be found in the pod status.
+	ContainerName string `json:"containerName,omitempty"`
+
+	// ContainerID is the id of the container the process ran in, as in the pod status,
+	// e.g. "containerd://<id>".
+	ContainerID string `json:"containerID"`
+
+	// NodeName is the node the process ran on.
+	NodeName string `json:"nodeName"`
+
+	// PID is the process id in the pid namespace of the node.
+	PID int32 `json:"pid"`
+
+	// Executable is the executable name of the process.
+	Executable string `json:"executable"`
+
+	// Signal is the number of the signal which caused the dump.
+	Signal int32 `json:"signal"`
+
+	// Size is the size of the core file in bytes, after compression.
+	Size int64 `json:"size"`
+
+	// ClaimName is the persistent volume claim the core file is saved in.
+	// It is empty when the core file is saved in HostPath.
+	ClaimName string `json:"claimName"`
+
+	// HostPath is the directory of the node NodeName the core file is saved in,
+	// when the pod has a host path volume rather than a claim.
+	HostPath string `json:"hostPath,omitempty"`
+
+	// Path is the path of the core file in the claim or in HostPath.
+	Path string `json:"path"`
+
+	// Time is when the process dumped its core.
+	Time metav1.Time `json:"time"`
+
+	// Suppressed is true when the core file is not saved, or deleted again, because
+	// the container dumped too many cores recently. Only its metadata is saved at
+	// Path with the `.json` suffix.
+	Suppressed bool `json:"suppressed,omitempty"`
+
+	// SuppressedCount is the number of the cores of the container suppressed
+	// since it last stopped dumping cores, this one included.
+	SuppressedCount int32 `json:"suppressedCount,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CoreDumpList is a list of CoreDumps.
+type CoreDumpList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CoreDump `json:"items"`
+}
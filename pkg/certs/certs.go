@@ -0,0 +1,237 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certs generates the certificates used between kube-apiserver and the
+// coredump-detector webhook: a self signed CA, a server certificate for the webhook,
+// and a client certificate for kube-apiserver.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// KeyType is the algorithm and size of the generated private keys.
+type KeyType string
+
+const (
+	RSA2048   KeyType = "rsa-2048"
+	RSA4096   KeyType = "rsa-4096"
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+	Ed25519   KeyType = "ed25519"
+)
+
+// KeyTypes lists the supported key types.
+var KeyTypes = []KeyType{RSA2048, RSA4096, ECDSAP256, ECDSAP384, Ed25519}
+
+// The file names used by the install guides.
+const (
+	CACertFile     = "ca.crt"
+	ServerCertFile = "server.cert"
+	ServerKeyFile  = "server.key"
+	ClientCertFile = "client.crt"
+	ClientKeyFile  = "client.key"
+)
+
+// Config describes the certificates to generate.
+type Config struct {
+	// CommonName is the common name of the server certificate.
+	CommonName string
+	// DNSNames and IPs are the subject alternative names of the server certificate.
+	DNSNames []string
+	IPs      []net.IP
+	KeyType  KeyType
+	// Validity is how long the certificates are valid from now on.
+	Validity time.Duration
+}
+
+// Bundle holds the PEM encoded certificates and keys.
+type Bundle struct {
+	CACert     []byte
+	ServerCert []byte
+	ServerKey  []byte
+	ClientCert []byte
+	ClientKey  []byte
+}
+
+// ServiceDNSNames returns the names kube-apiserver may use to reach a service.
+func ServiceDNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// Generate creates a new CA, and signs a server and a client certificate with it.
+func Generate(config Config) (*Bundle, error) {
+	if len(config.CommonName) == 0 {
+		return nil, fmt.Errorf("the common name of the server certificate is empty")
+	}
+	if config.Validity <= 0 {
+		return nil, fmt.Errorf("invalid validity %v", config.Validity)
+	}
+	notBefore := time.Now().Add(-time.Minute)
+	notAfter := notBefore.Add(config.Validity)
+
+	caKey, err := newKey(config.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s@%d", config.CommonName, time.Now().Unix())},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCert, caDER, err := sign(caTemplate, caKey.Public(), caTemplate, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	serverKey, err := newKey(config.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	_, serverDER, err := sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: config.CommonName},
+		DNSNames:    config.DNSNames,
+		IPAddresses: config.IPs,
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, serverKey.Public(), caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client certificate kube-apiserver presents to the webhook
+	clientKey, err := newKey(config.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	_, clientDER, err := sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client", Organization: []string{"system:masters"}},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, clientKey.Public(), caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{
+		CACert:     encodeCert(caDER),
+		ServerCert: encodeCert(serverDER),
+		ClientCert: encodeCert(clientDER),
+	}
+	if bundle.ServerKey, err = encodeKey(serverKey); err != nil {
+		return nil, err
+	}
+	if bundle.ClientKey, err = encodeKey(clientKey); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// WriteFiles writes the bundle to dir as ca.crt, server.cert, server.key, client.crt and client.key.
+func (b *Bundle) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{CACertFile, b.CACert, 0644},
+		{ServerCertFile, b.ServerCert, 0644},
+		{ServerKeyFile, b.ServerKey, 0600},
+		{ClientCertFile, b.ClientCert, 0644},
+		{ClientKeyFile, b.ClientKey, 0600},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), f.data, f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %q, expect one of %v", keyType, KeyTypes)
+}
+
+// sign issues template for pub, signed by the parent certificate and its key.
+func sign(template *x509.Certificate, pub crypto.PublicKey, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, []byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, der, nil
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
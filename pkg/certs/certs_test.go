@@ -0,0 +1,105 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.Nil(t, err)
+	return cert
+}
+
+func TestGenerate(t *testing.T) {
+	for _, keyType := range KeyTypes {
+		bundle, err := Generate(Config{
+			CommonName: "coredump-detector.default.svc",
+			DNSNames:   ServiceDNSNames("coredump-detector", "default"),
+			IPs:        []net.IP{net.ParseIP("10.0.0.1")},
+			KeyType:    keyType,
+			Validity:   24 * time.Hour,
+		})
+		require.Nil(t, err, "key type %s", keyType)
+
+		roots := x509.NewCertPool()
+		require.True(t, roots.AppendCertsFromPEM(bundle.CACert))
+
+		server := parseCert(t, bundle.ServerCert)
+		for _, name := range []string{"coredump-detector.default.svc", "coredump-detector.default.svc.cluster.local", "10.0.0.1"} {
+			_, err := server.Verify(x509.VerifyOptions{
+				DNSName:   name,
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			assert.Nil(t, err, "key type %s: server certificate is not valid for %s", keyType, name)
+		}
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), server.NotAfter, 2*time.Minute)
+
+		client := parseCert(t, bundle.ClientCert)
+		_, err = client.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		assert.Nil(t, err, "key type %s: client certificate is not valid", keyType)
+
+		_, err = tls.X509KeyPair(bundle.ServerCert, bundle.ServerKey)
+		assert.Nil(t, err, "key type %s: server key does not match", keyType)
+		_, err = tls.X509KeyPair(bundle.ClientCert, bundle.ClientKey)
+		assert.Nil(t, err, "key type %s: client key does not match", keyType)
+	}
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	_, err := Generate(Config{CommonName: "foo", KeyType: "dsa", Validity: time.Hour})
+	assert.NotNil(t, err)
+	_, err = Generate(Config{CommonName: "foo", KeyType: ECDSAP256})
+	assert.NotNil(t, err)
+	_, err = Generate(Config{KeyType: ECDSAP256, Validity: time.Hour})
+	assert.NotNil(t, err)
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bundle, err := Generate(Config{CommonName: "10.0.0.1", IPs: []net.IP{net.ParseIP("10.0.0.1")}, KeyType: ECDSAP256, Validity: time.Hour})
+	require.Nil(t, err)
+	output := filepath.Join(dir, "output")
+	require.Nil(t, bundle.WriteFiles(output))
+
+	for _, name := range []string{"ca.crt", "server.cert", "server.key", "client.crt", "client.key"} {
+		_, err := os.Stat(filepath.Join(output, name))
+		assert.Nil(t, err, "%s is not written", name)
+	}
+	info, err := os.Stat(filepath.Join(output, "server.key"))
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,91 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cgroup finds the pod and the container a process runs in from its cgroup path.
+// Both the cgroupfs and the systemd cgroup drivers of kubelet are supported, on cgroup v1 and v2.
+package cgroup
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Container identifies the container of a pod a process runs in.
+type Container struct {
+	// PodUID is the uid of the pod.
+	PodUID string
+	// ID is the container id as the container runtime reports it, without the runtime prefix.
+	ID string
+}
+
+var (
+	// podRE matches pod<uid> in a cgroup path component. The systemd driver replaces
+	// the dashes of the uid with underscores.
+	podRE = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(\.slice)?$`)
+	// containerRE matches the container component, e.g. <id>, docker-<id>.scope,
+	// cri-containerd-<id>.scope or crio-<id>.scope.
+	containerRE = regexp.MustCompile(`^(?:(?:docker|cri-containerd|crio|containerd)-)?([0-9a-f]{64})(?:\.scope)?$`)
+)
+
+// Parse reads the content of /proc/<pid>/cgroup. ok is false when none of the
+// cgroups of the process belongs to a container of a pod.
+func Parse(r io.Reader) (c Container, ok bool, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if c, ok := parsePath(fields[2]); ok {
+			return c, true, nil
+		}
+	}
+	return Container{}, false, scanner.Err()
+}
+
+// parsePath looks for a pod component directly followed by a container component.
+func parsePath(path string) (Container, bool) {
+	components := strings.Split(path, "/")
+	for i := 0; i+1 < len(components); i++ {
+		pod := podRE.FindStringSubmatch(components[i])
+		if pod == nil {
+			continue
+		}
+		container := containerRE.FindStringSubmatch(components[i+1])
+		if container == nil {
+			continue
+		}
+		return Container{
+			PodUID: strings.Replace(pod[1], "_", "-", -1),
+			ID:     container[1],
+		}, true
+	}
+	return Container{}, false
+}
+
+// Lookup parses the cgroup file of process pid in the proc filesystem mounted at procRoot.
+func Lookup(procRoot string, pid int) (Container, bool, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return Container{}, false, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
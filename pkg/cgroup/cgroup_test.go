@@ -0,0 +1,74 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const containerID = "8e5b8c2a7a3c6d8a9b1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c"
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cgroup   string
+		expected Container
+		ok       bool
+	}{
+		{
+			name: "cgroupfs v1",
+			cgroup: "12:pids:/kubepods/burstable/pod3f9d1c2e-5a4b-4c3d-8e7f-1a2b3c4d5e6f/" + containerID + "\n" +
+				"11:memory:/kubepods/burstable/pod3f9d1c2e-5a4b-4c3d-8e7f-1a2b3c4d5e6f/" + containerID + "\n",
+			expected: Container{PodUID: "3f9d1c2e-5a4b-4c3d-8e7f-1a2b3c4d5e6f", ID: containerID},
+			ok:       true,
+		},
+		{
+			name: "systemd v2 containerd",
+			cgroup: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod3f9d1c2e_5a4b_4c3d_8e7f_1a2b3c4d5e6f.slice/" +
+				"cri-containerd-" + containerID + ".scope\n",
+			expected: Container{PodUID: "3f9d1c2e-5a4b-4c3d-8e7f-1a2b3c4d5e6f", ID: containerID},
+			ok:       true,
+		},
+		{
+			name:     "systemd v1 cri-o guaranteed",
+			cgroup:   "4:cpu,cpuacct:/kubepods.slice/kubepods-pod3f9d1c2e_5a4b_4c3d_8e7f_1a2b3c4d5e6f.slice/crio-" + containerID + ".scope\n",
+			expected: Container{PodUID: "3f9d1c2e-5a4b-4c3d-8e7f-1a2b3c4d5e6f", ID: containerID},
+			ok:       true,
+		},
+		{
+			name:   "conmon of cri-o",
+			cgroup: "0::/kubepods.slice/kubepods-pod3f9d1c2e_5a4b_4c3d_8e7f_1a2b3c4d5e6f.slice/crio-conmon-" + containerID + ".scope\n",
+		},
+		{
+			name:   "host process",
+			cgroup: "0::/system.slice/sshd.service\n",
+		},
+		{
+			name:   "empty",
+			cgroup: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		c, ok, err := Parse(strings.NewReader(tc.cgroup))
+		require.Nil(t, err, tc.name)
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.expected, c, tc.name)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package compression compresses core files with gzip or zstd while they are
+// written, and detects the format when they are read back.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm is a compression algorithm.
+type Algorithm string
+
+const (
+	None Algorithm = "none"
+	Gzip Algorithm = "gzip"
+	Zstd Algorithm = "zstd"
+)
+
+// Algorithms are the supported algorithms.
+var Algorithms = []Algorithm{None, Gzip, Zstd}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Parse returns the algorithm named s. An empty s is None.
+func Parse(s string) (Algorithm, error) {
+	if len(s) == 0 {
+		return None, nil
+	}
+	for _, a := range Algorithms {
+		if string(a) == s {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compression %q, expect one of %v", s, Algorithms)
+}
+
+// Extension is the file name extension of the algorithm, e.g. ".gz".
+func (a Algorithm) Extension() string {
+	switch a {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// NewWriter returns a writer compressing into w. Closing it flushes the compressed
+// data, but does not close w. An empty algorithm is None.
+func NewWriter(a Algorithm, w io.Writer) (io.WriteCloser, error) {
+	switch a {
+	case None, "":
+		return nopCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", a)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// NewReader returns a reader decompressing r. The algorithm is detected from the
+// first bytes of r, data which is not compressed is read as it is.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// TrimExtension removes the extension of any of the algorithms from name.
+func TrimExtension(name string) string {
+	for _, a := range Algorithms {
+		if ext := a.Extension(); len(ext) != 0 && strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
@@ -0,0 +1,71 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	// cores are mostly zero pages
+	data := append([]byte("\x7fELF"), make([]byte, 1<<20)...)
+	for _, a := range Algorithms {
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(a, buf)
+		require.Nil(t, err, a)
+		_, err = w.Write(data)
+		require.Nil(t, err, a)
+		require.Nil(t, w.Close(), a)
+		if a != None {
+			assert.True(t, buf.Len() < len(data)/100, "%s: compressed to %d bytes", a, buf.Len())
+		}
+
+		r, err := NewReader(buf)
+		require.Nil(t, err, a)
+		out, err := ioutil.ReadAll(r)
+		require.Nil(t, err, a)
+		assert.Equal(t, data, out, a)
+		require.Nil(t, r.Close(), a)
+	}
+}
+
+func TestNewReaderShortInput(t *testing.T) {
+	r, err := NewReader(bytes.NewBufferString("a"))
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, "a", string(out))
+}
+
+func TestParse(t *testing.T) {
+	for s, expected := range map[string]Algorithm{"": None, "none": None, "gzip": Gzip, "zstd": Zstd} {
+		a, err := Parse(s)
+		require.Nil(t, err, s)
+		assert.Equal(t, expected, a, s)
+	}
+	_, err := Parse("bzip2")
+	assert.NotNil(t, err)
+}
+
+func TestTrimExtension(t *testing.T) {
+	assert.Equal(t, "core_a_1.1", TrimExtension("core_a_1.1.gz"))
+	assert.Equal(t, "core_a_1.1", TrimExtension("core_a_1.1.zst"))
+	assert.Equal(t, "core_a_1.1", TrimExtension("core_a_1.1"))
+}
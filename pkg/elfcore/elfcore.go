@@ -0,0 +1,512 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package elfcore reads the metadata of a crashed process from the notes of its ELF
+// core file, so that crashes can be triaged without loading the core into a debugger.
+//
+// The layouts of the notes are those of Linux on 64 bit architectures, and on
+// 32 bit architectures with 16 bit uids such as i386 and arm.
+package elfcore
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+)
+
+// Metadata describes the crashed process.
+type Metadata struct {
+	// Machine is the architecture of the process, e.g. EM_X86_64.
+	Machine string `json:"machine"`
+	PID     int32  `json:"pid"`
+	PPID    int32  `json:"ppid"`
+	UID     uint32 `json:"uid"`
+	GID     uint32 `json:"gid"`
+	// Command is the executable name, truncated to 15 characters by the kernel.
+	Command string `json:"command"`
+	// Args is the command line, truncated to 80 characters by the kernel.
+	Args string `json:"args"`
+	// Executable is the path the process was executed with, if it could be found in the core.
+	Executable string `json:"executable,omitempty"`
+	// Signal is the number of the signal which killed the process.
+	Signal int32 `json:"signal"`
+	// SignalCode tells why the signal was sent, e.g. 1 (SEGV_MAPERR) for SIGSEGV.
+	SignalCode int32 `json:"signalCode"`
+	// FaultAddress is the memory address which caused the fault, for SIGSEGV,
+	// SIGBUS, SIGILL, SIGFPE and SIGTRAP raised by the kernel.
+	FaultAddress *uint64 `json:"faultAddress,omitempty"`
+	// Threads are the threads of the process, the one which received the signal first.
+	Threads []Thread `json:"threads"`
+	// Auxv is the auxiliary vector, keyed by the names of the entries, e.g. AT_ENTRY.
+	Auxv map[string]uint64 `json:"auxv,omitempty"`
+	// Files are the files mapped into the memory of the process.
+	Files []MappedFile `json:"files,omitempty"`
+}
+
+// Thread is a thread of the crashed process.
+type Thread struct {
+	TID int32 `json:"tid"`
+	// Signal is the signal pending on the thread, 0 if there is none.
+	Signal int16 `json:"signal"`
+}
+
+// MappedFile is a file mapped into the memory of the process.
+type MappedFile struct {
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`
+	Offset uint64 `json:"offset"`
+	Path   string `json:"path"`
+	// BuildID is the GNU build-id of the file in hex, if its ELF header is in the core.
+	BuildID string `json:"buildID,omitempty"`
+}
+
+// note types which are not in debug/elf
+const (
+	ntPrstatus   = 1
+	ntPrpsinfo   = 3
+	ntAuxv       = 6
+	ntSiginfo    = 0x53494749
+	ntFile       = 0x46494c45
+	ntGNUBuildID = 3
+)
+
+var auxvNames = map[uint64]string{
+	3:  "AT_PHDR",
+	4:  "AT_PHENT",
+	5:  "AT_PHNUM",
+	6:  "AT_PAGESZ",
+	7:  "AT_BASE",
+	8:  "AT_FLAGS",
+	9:  "AT_ENTRY",
+	11: "AT_UID",
+	12: "AT_EUID",
+	13: "AT_GID",
+	14: "AT_EGID",
+	15: "AT_PLATFORM",
+	16: "AT_HWCAP",
+	17: "AT_CLKTCK",
+	23: "AT_SECURE",
+	25: "AT_RANDOM",
+	26: "AT_HWCAP2",
+	27: "AT_RSEQ_FEATURE_SIZE",
+	28: "AT_RSEQ_ALIGN",
+	31: "AT_EXECFN",
+	33: "AT_SYSINFO_EHDR",
+	51: "AT_MINSIGSTKSZ",
+}
+
+// faultSignals are the signals whose siginfo carries the faulting address.
+var faultSignals = map[int32]bool{
+	4:  true, // SIGILL
+	5:  true, // SIGTRAP
+	7:  true, // SIGBUS
+	8:  true, // SIGFPE
+	11: true, // SIGSEGV
+}
+
+type note struct {
+	name string
+	typ  uint32
+	desc []byte
+}
+
+// core wraps an ELF core file with the helpers to decode words of its class.
+type core struct {
+	*elf.File
+	word int
+}
+
+func (c *core) uint(b []byte) uint64 {
+	if c.word == 8 {
+		return c.ByteOrder.Uint64(b)
+	}
+	return uint64(c.ByteOrder.Uint32(b))
+}
+
+// Parse reads the metadata from the notes of the core file r.
+func Parse(r io.ReaderAt) (*Metadata, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Type != elf.ET_CORE {
+		return nil, fmt.Errorf("not a core file, the type is %s", f.Type)
+	}
+	c := &core{File: f, word: 4}
+	if f.Class == elf.ELFCLASS64 {
+		c.word = 8
+	}
+
+	notes, err := c.notes()
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{Machine: f.Machine.String()}
+	for _, n := range notes {
+		if n.name != "CORE" {
+			continue
+		}
+		switch n.typ {
+		case ntPrstatus:
+			err = c.parsePrstatus(m, n.desc)
+		case ntPrpsinfo:
+			err = c.parsePrpsinfo(m, n.desc)
+		case ntSiginfo:
+			err = c.parseSiginfo(m, n.desc)
+		case ntAuxv:
+			err = c.parseAuxv(m, n.desc)
+		case ntFile:
+			err = c.parseFile(m, n.desc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if addr, ok := m.Auxv["AT_EXECFN"]; ok {
+		m.Executable = c.readString(addr)
+	}
+	for i := range m.Files {
+		if m.Files[i].Offset == 0 {
+			m.Files[i].BuildID = c.buildID(m.Files[i].Start, m.Files[i].End)
+		}
+	}
+	return m, nil
+}
+
+// notes returns the notes in all PT_NOTE segments.
+func (c *core) notes() ([]note, error) {
+	var notes []note
+	for _, prog := range c.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, fmt.Errorf("failed to read notes: %v", err)
+		}
+		n, err := parseNotes(data, c.ByteOrder)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, n...)
+	}
+	return notes, nil
+}
+
+// parseNotes splits data into notes. Names and descriptors are aligned to 4 bytes.
+func parseNotes(data []byte, order binary.ByteOrder) ([]note, error) {
+	var notes []note
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, fmt.Errorf("truncated note header")
+		}
+		namesz := uint64(order.Uint32(data[0:]))
+		descsz := uint64(order.Uint32(data[4:]))
+		typ := order.Uint32(data[8:])
+		data = data[12:]
+		nameEnd := align4(namesz)
+		descEnd := nameEnd + align4(descsz)
+		if descEnd > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated note of type %#x", typ)
+		}
+		notes = append(notes, note{
+			name: string(bytes.TrimRight(data[:namesz], "\x00")),
+			typ:  typ,
+			desc: data[nameEnd : nameEnd+descsz],
+		})
+		data = data[descEnd:]
+	}
+	return notes, nil
+}
+
+func align4(n uint64) uint64 {
+	return (n + 3) &^ 3
+}
+
+// parsePrstatus reads the signal and the thread id from struct elf_prstatus.
+// There is one of it for every thread, the first for the thread which crashed.
+func (c *core) parsePrstatus(m *Metadata, desc []byte) error {
+	// struct elf_siginfo (3 ints), short pr_cursig, 2 unsigned longs, then pr_pid
+	pid := 16 + 2*c.word
+	if len(desc) < pid+4 {
+		return fmt.Errorf("truncated NT_PRSTATUS")
+	}
+	t := Thread{
+		TID:    int32(c.ByteOrder.Uint32(desc[pid:])),
+		Signal: int16(c.ByteOrder.Uint16(desc[12:])),
+	}
+	if len(m.Threads) == 0 && m.Signal == 0 {
+		m.Signal = int32(t.Signal)
+	}
+	m.Threads = append(m.Threads, t)
+	return nil
+}
+
+// parsePrpsinfo reads the ids and the command line from struct elf_prpsinfo.
+func (c *core) parsePrpsinfo(m *Metadata, desc []byte) error {
+	// 4 chars, then unsigned long pr_flag
+	off := 4
+	if c.word == 8 {
+		off = 8
+	}
+	off += c.word
+	uidSize := 4
+	if c.word == 4 {
+		uidSize = 2
+	}
+	fname := off + 2*uidSize + 16
+	if len(desc) < fname+16+80 {
+		return fmt.Errorf("truncated NT_PRPSINFO")
+	}
+	if uidSize == 4 {
+		m.UID = c.ByteOrder.Uint32(desc[off:])
+		m.GID = c.ByteOrder.Uint32(desc[off+4:])
+	} else {
+		m.UID = uint32(c.ByteOrder.Uint16(desc[off:]))
+		m.GID = uint32(c.ByteOrder.Uint16(desc[off+2:]))
+	}
+	off += 2 * uidSize
+	m.PID = int32(c.ByteOrder.Uint32(desc[off:]))
+	m.PPID = int32(c.ByteOrder.Uint32(desc[off+4:]))
+	m.Command = cString(desc[fname : fname+16])
+	m.Args = cString(desc[fname+16 : fname+16+80])
+	return nil
+}
+
+// parseSiginfo reads the signal and the faulting address from siginfo_t.
+func (c *core) parseSiginfo(m *Metadata, desc []byte) error {
+	// int si_signo, si_errno, si_code, then the union aligned to a pointer
+	addr := 12
+	if c.word == 8 {
+		addr = 16
+	}
+	if len(desc) < addr+c.word {
+		return fmt.Errorf("truncated NT_SIGINFO")
+	}
+	m.Signal = int32(c.ByteOrder.Uint32(desc[0:]))
+	m.SignalCode = int32(c.ByteOrder.Uint32(desc[8:]))
+	// si_code <= 0 means the signal was sent by a process rather than by a fault
+	if faultSignals[m.Signal] && m.SignalCode > 0 {
+		a := c.uint(desc[addr:])
+		m.FaultAddress = &a
+	}
+	return nil
+}
+
+// parseAuxv reads the pairs of the auxiliary vector up to AT_NULL.
+func (c *core) parseAuxv(m *Metadata, desc []byte) error {
+	m.Auxv = map[string]uint64{}
+	for off := 0; off+2*c.word <= len(desc); off += 2 * c.word {
+		typ := c.uint(desc[off:])
+		if typ == 0 {
+			break
+		}
+		name, ok := auxvNames[typ]
+		if !ok {
+			name = fmt.Sprintf("AT_%d", typ)
+		}
+		m.Auxv[name] = c.uint(desc[off+c.word:])
+	}
+	return nil
+}
+
+// parseFile reads the mapped files: count and page size, count triples of
+// start, end and offset in pages, then count NUL terminated paths.
+func (c *core) parseFile(m *Metadata, desc []byte) error {
+	if len(desc) < 2*c.word {
+		return fmt.Errorf("truncated NT_FILE")
+	}
+	count := c.uint(desc)
+	pageSize := c.uint(desc[c.word:])
+	names := 2*uint64(c.word) + 3*uint64(c.word)*count
+	if count > uint64(len(desc)) || names > uint64(len(desc)) {
+		return fmt.Errorf("truncated NT_FILE")
+	}
+	paths := bytes.Split(desc[names:], []byte{0})
+	if uint64(len(paths)) < count {
+		return fmt.Errorf("NT_FILE has %d paths for %d files", len(paths), count)
+	}
+	for i := uint64(0); i < count; i++ {
+		entry := desc[2*uint64(c.word)+3*uint64(c.word)*i:]
+		m.Files = append(m.Files, MappedFile{
+			Start:  c.uint(entry),
+			End:    c.uint(entry[c.word:]),
+			Offset: c.uint(entry[2*c.word:]) * pageSize,
+			Path:   string(paths[i]),
+		})
+	}
+	return nil
+}
+
+// readMemory reads the memory of the process at addr from the PT_LOAD segments.
+// It fails when the memory was not dumped.
+func (c *core) readMemory(addr uint64, data []byte) error {
+	for _, prog := range c.Progs {
+		if prog.Type != elf.PT_LOAD || addr < prog.Vaddr || addr+uint64(len(data)) > prog.Vaddr+prog.Filesz {
+			continue
+		}
+		_, err := prog.ReadAt(data, int64(addr-prog.Vaddr))
+		return err
+	}
+	return fmt.Errorf("memory at %#x is not in the core", addr)
+}
+
+// readString reads a NUL terminated string of at most 4096 bytes at addr.
+func (c *core) readString(addr uint64) string {
+	var s []byte
+	buf := make([]byte, 64)
+	for len(s) < 4096 {
+		if err := c.readMemory(addr+uint64(len(s)), buf); err != nil {
+			// the string may end near the end of the segment
+			buf = buf[:1]
+			if err := c.readMemory(addr+uint64(len(s)), buf); err != nil {
+				return ""
+			}
+		}
+		if i := bytes.IndexByte(buf, 0); i >= 0 {
+			return string(append(s, buf[:i]...))
+		}
+		s = append(s, buf...)
+	}
+	return ""
+}
+
+// maxBuildIDNotesSize bounds the notes read by buildID. The build-id note is in the
+// first page, where the kernel dumps it.
+const maxBuildIDNotesSize = 4096
+
+// buildID reads the GNU build-id of the ELF file mapped at start from offset 0.
+// The kernel dumps the first page of such mappings by default, which holds the ELF
+// header, the program headers and usually the build-id note. The section headers
+// are usually not dumped, so the program headers are parsed by hand rather than
+// with debug/elf.
+func (c *core) buildID(start, end uint64) string {
+	if end <= start {
+		return ""
+	}
+	// the offsets and sizes below are read from the memory of the crashed process,
+	// so they are checked against the mapping without overflowing
+	length := end - start
+	ident := make([]byte, elf.EI_NIDENT)
+	if err := c.readMemory(start, ident); err != nil || string(ident[:4]) != elf.ELFMAG {
+		return ""
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(ident[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	// offsets of e_phoff, e_phentsize, p_offset and p_filesz
+	phoff, phentsize, poffset, pfilesz, word := 28, 42, 4, 16, 4
+	if elf.Class(ident[elf.EI_CLASS]) == elf.ELFCLASS64 {
+		phoff, phentsize, poffset, pfilesz, word = 32, 54, 8, 32, 8
+	}
+	readUint := func(b []byte) uint64 {
+		if word == 8 {
+			return order.Uint64(b)
+		}
+		return uint64(order.Uint32(b))
+	}
+
+	header := make([]byte, phentsize+4)
+	if err := c.readMemory(start, header); err != nil {
+		return ""
+	}
+	off := readUint(header[phoff:])
+	size := uint64(order.Uint16(header[phentsize:]))
+	num := uint64(order.Uint16(header[phentsize+2:]))
+	if off > length {
+		return ""
+	}
+	for i := uint64(0); i < num; i++ {
+		// i*size is below 2^32, as both are read from 16 bits
+		if size < uint64(pfilesz+word) || i*size > length-off || size > length-off-i*size {
+			return ""
+		}
+		phdr := make([]byte, size)
+		if c.readMemory(start+off+i*size, phdr) != nil {
+			return ""
+		}
+		if elf.ProgType(order.Uint32(phdr)) != elf.PT_NOTE {
+			continue
+		}
+		noteOff, noteSize := readUint(phdr[poffset:]), readUint(phdr[pfilesz:])
+		if noteOff > length || noteSize > length-noteOff || noteSize > maxBuildIDNotesSize {
+			continue
+		}
+		data := make([]byte, noteSize)
+		if err := c.readMemory(start+noteOff, data); err != nil {
+			continue
+		}
+		notes, err := parseNotes(data, order)
+		if err != nil {
+			continue
+		}
+		for _, n := range notes {
+			if n.name == "GNU" && n.typ == ntGNUBuildID {
+				return hex.EncodeToString(n.desc)
+			}
+		}
+	}
+	return ""
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// WriteSidecar parses the core file at path and writes its metadata to `<path>.json`.
+// The core file may be compressed by any of the algorithms of package compression.
+func WriteSidecar(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := compression.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to decompress core file %s: %v", path, err)
+	}
+	defer r.Close()
+	m, err := ParseStream(r)
+	if err != nil {
+		return fmt.Errorf("failed to parse core file %s: %v", path, err)
+	}
+	out, err := os.OpenFile(path+".json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := m.Write(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Write encodes the metadata as indented JSON.
+func (m *Metadata) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
@@ -0,0 +1,275 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package elfcore
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+)
+
+var order = binary.LittleEndian
+
+const (
+	// the executable is mapped at execStart, with its path written at execFnAddr
+	execStart  = 0x400000
+	execFnAddr = execStart + 0x800
+	pageSize   = 0x1000
+)
+
+var buildID = []byte{0x9d, 0xa1, 0x11, 0x3d, 0xdb, 0x2c, 0x98, 0x35, 0x63, 0x95, 0x53, 0xdd, 0x9c, 0x23, 0x27, 0xab, 0xc6, 0x10, 0x6a, 0x01}
+
+func appendNote(buf *bytes.Buffer, name string, typ uint32, desc []byte) {
+	binary.Write(buf, order, uint32(len(name)+1))
+	binary.Write(buf, order, uint32(len(desc)))
+	binary.Write(buf, order, typ)
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	pad(buf)
+	buf.Write(desc)
+	pad(buf)
+}
+
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+func words(values ...uint64) []byte {
+	buf := &bytes.Buffer{}
+	for _, v := range values {
+		binary.Write(buf, order, v)
+	}
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, typ elf.Type, phnum int) {
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)})
+	buf.Write(make([]byte, elf.EI_NIDENT-7))
+	binary.Write(buf, order, uint16(typ))
+	binary.Write(buf, order, uint16(elf.EM_X86_64))
+	binary.Write(buf, order, uint32(elf.EV_CURRENT))
+	binary.Write(buf, order, uint64(0))  // entry
+	binary.Write(buf, order, uint64(64)) // phoff
+	binary.Write(buf, order, uint64(0))  // shoff
+	binary.Write(buf, order, uint32(0))  // flags
+	binary.Write(buf, order, uint16(64)) // ehsize
+	binary.Write(buf, order, uint16(56)) // phentsize
+	binary.Write(buf, order, uint16(phnum))
+	binary.Write(buf, order, uint16(0)) // shentsize
+	binary.Write(buf, order, uint16(0)) // shnum
+	binary.Write(buf, order, uint16(0)) // shstrndx
+}
+
+// executablePage returns the first page of an executable with a build-id note,
+// with the path of the executable at execFnAddr.
+func executablePage() []byte {
+	return executablePageWithNote(0x100, 0)
+}
+
+// executablePageWithNote returns executablePage with the given p_offset and p_filesz
+// of its PT_NOTE. A zero p_filesz is the size of the notes.
+func executablePageWithNote(noteOff, noteSize uint64) []byte {
+	notes := &bytes.Buffer{}
+	appendNote(notes, "GNU", ntGNUBuildID, buildID)
+	if noteSize == 0 {
+		noteSize = uint64(notes.Len())
+	}
+
+	buf := &bytes.Buffer{}
+	writeHeader(buf, elf.ET_DYN, 1)
+	binary.Write(buf, order, elf.Prog64{Type: uint32(elf.PT_NOTE), Off: noteOff, Vaddr: 0x100, Filesz: noteSize, Memsz: noteSize, Align: 4})
+	buf.Write(make([]byte, 0x100-buf.Len()))
+	buf.Write(notes.Bytes())
+	buf.Write(make([]byte, execFnAddr-execStart-buf.Len()))
+	buf.WriteString("/usr/bin/crash\x00")
+	buf.Write(make([]byte, pageSize-buf.Len()))
+	return buf.Bytes()
+}
+
+// testCore returns a core file of a process killed by SIGSEGV at address 0x10.
+func testCore() []byte {
+	return testCoreWithPage(executablePage())
+}
+
+// testCoreWithPage returns testCore with page as the first page of the executable.
+func testCoreWithPage(page []byte) []byte {
+	notes := &bytes.Buffer{}
+
+	prstatus := make([]byte, 336)
+	order.PutUint16(prstatus[12:], 11)
+	order.PutUint32(prstatus[32:], 1234)
+	appendNote(notes, "CORE", ntPrstatus, prstatus)
+	prstatus = make([]byte, 336)
+	order.PutUint32(prstatus[32:], 1235)
+	appendNote(notes, "CORE", ntPrstatus, prstatus)
+
+	prpsinfo := make([]byte, 136)
+	order.PutUint32(prpsinfo[16:], 1000)
+	order.PutUint32(prpsinfo[20:], 100)
+	order.PutUint32(prpsinfo[24:], 1234)
+	order.PutUint32(prpsinfo[28:], 1)
+	copy(prpsinfo[40:], "crash")
+	copy(prpsinfo[56:], "/usr/bin/crash --foo bar")
+	appendNote(notes, "CORE", ntPrpsinfo, prpsinfo)
+
+	siginfo := make([]byte, 128)
+	order.PutUint32(siginfo[0:], 11)
+	order.PutUint32(siginfo[8:], 1)
+	order.PutUint64(siginfo[16:], 0x10)
+	appendNote(notes, "CORE", ntSiginfo, siginfo)
+
+	appendNote(notes, "CORE", ntAuxv, words(6, pageSize, 9, execStart+0x40, 31, execFnAddr, 1000, 7, 0, 0))
+
+	file := &bytes.Buffer{}
+	file.Write(words(2, pageSize, execStart, execStart+pageSize, 0, execStart+pageSize, execStart+2*pageSize, 1))
+	file.WriteString("/usr/bin/crash\x00/usr/bin/crash\x00")
+	appendNote(notes, "CORE", ntFile, file.Bytes())
+	// notes of other owners are skipped
+	appendNote(notes, "LINUX", ntPrstatus, make([]byte, 8))
+
+	notesOff := uint64(64 + 2*56)
+	loadOff := notesOff + uint64(notes.Len())
+
+	buf := &bytes.Buffer{}
+	writeHeader(buf, elf.ET_CORE, 2)
+	binary.Write(buf, order, elf.Prog64{Type: uint32(elf.PT_NOTE), Off: notesOff, Filesz: uint64(notes.Len()), Align: 4})
+	binary.Write(buf, order, elf.Prog64{Type: uint32(elf.PT_LOAD), Off: loadOff, Vaddr: execStart, Filesz: pageSize, Memsz: pageSize, Align: pageSize})
+	buf.Write(notes.Bytes())
+	buf.Write(page)
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse(bytes.NewReader(testCore()))
+	require.Nil(t, err)
+	faultAddress := uint64(0x10)
+	assert.Equal(t, &Metadata{
+		Machine:      "EM_X86_64",
+		PID:          1234,
+		PPID:         1,
+		UID:          1000,
+		GID:          100,
+		Command:      "crash",
+		Args:         "/usr/bin/crash --foo bar",
+		Executable:   "/usr/bin/crash",
+		Signal:       11,
+		SignalCode:   1,
+		FaultAddress: &faultAddress,
+		Threads:      []Thread{{TID: 1234, Signal: 11}, {TID: 1235}},
+		Auxv: map[string]uint64{
+			"AT_PAGESZ": pageSize,
+			"AT_ENTRY":  execStart + 0x40,
+			"AT_EXECFN": execFnAddr,
+			"AT_1000":   7,
+		},
+		Files: []MappedFile{
+			{Start: execStart, End: execStart + pageSize, Offset: 0, Path: "/usr/bin/crash", BuildID: "9da1113ddb2c9835639553dd9c2327abc6106a01"},
+			{Start: execStart + pageSize, End: execStart + 2*pageSize, Offset: pageSize, Path: "/usr/bin/crash"},
+		},
+	}, m)
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse(bytes.NewReader([]byte("not a core file")))
+	assert.NotNil(t, err)
+
+	// an executable rather than a core
+	_, err = Parse(bytes.NewReader(executablePage()))
+	assert.NotNil(t, err)
+
+	// a core truncated in the middle of the notes
+	_, err = Parse(bytes.NewReader(testCore()[:300]))
+	assert.NotNil(t, err)
+}
+
+func TestParseMalformedBuildIDNote(t *testing.T) {
+	for i, page := range [][]byte{
+		// start+p_offset+p_filesz wraps around to 1
+		executablePageWithNote(0x100, ^uint64(0)-execStart-0x100+2),
+		// start+p_offset wraps around to 0
+		executablePageWithNote(^uint64(0)-execStart+1, 0x100),
+		executablePageWithNote(^uint64(0), ^uint64(0)),
+		// within the mapping, but larger than a page
+		executablePageWithNote(0, 2*pageSize),
+	} {
+		m, err := Parse(bytes.NewReader(testCoreWithPage(page)))
+		require.Nil(t, err, "test %d", i)
+		assert.Empty(t, m.Files[0].BuildID, "test %d", i)
+		assert.Equal(t, "/usr/bin/crash", m.Executable, "test %d", i)
+
+		m, err = ParseStream(bytes.NewReader(testCoreWithPage(page)))
+		require.Nil(t, err, "test %d", i)
+		assert.Empty(t, m.Files[0].BuildID, "test %d", i)
+	}
+}
+
+func TestParseStream(t *testing.T) {
+	expected, err := Parse(bytes.NewReader(testCore()))
+	require.Nil(t, err)
+	m, err := ParseStream(bytes.NewReader(testCore()))
+	require.Nil(t, err)
+	assert.Equal(t, expected, m)
+
+	// the memory is cut off, but the notes are complete
+	core := testCore()
+	m, err = ParseStream(bytes.NewReader(core[:len(core)-pageSize+0x200]))
+	require.Nil(t, err)
+	assert.Equal(t, "9da1113ddb2c9835639553dd9c2327abc6106a01", m.Files[0].BuildID)
+	assert.Empty(t, m.Executable)
+
+	_, err = ParseStream(bytes.NewReader(core[:300]))
+	assert.NotNil(t, err)
+	_, err = ParseStream(bytes.NewReader([]byte("not a core file, but long enough for an ELF header .........")))
+	assert.NotNil(t, err)
+}
+
+func TestWriteSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elfcore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "core_crash_1539000000")
+	require.Nil(t, ioutil.WriteFile(path, testCore(), 0600))
+	require.Nil(t, WriteSidecar(path))
+	data, err := ioutil.ReadFile(path + ".json")
+	require.Nil(t, err)
+	assert.Contains(t, string(data), `"faultAddress": 16`)
+	assert.Contains(t, string(data), `"buildID": "9da1113ddb2c9835639553dd9c2327abc6106a01"`)
+
+	buf := &bytes.Buffer{}
+	w, err := compression.NewWriter(compression.Zstd, buf)
+	require.Nil(t, err)
+	w.Write(testCore())
+	require.Nil(t, w.Close())
+	require.Nil(t, ioutil.WriteFile(path+".zst", buf.Bytes(), 0600))
+	require.Nil(t, WriteSidecar(path+".zst"))
+	compressed, err := ioutil.ReadFile(path + ".zst.json")
+	require.Nil(t, err)
+	assert.Equal(t, string(data), string(compressed))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("truncated"), 0600))
+	assert.NotNil(t, WriteSidecar(path))
+}
@@ -0,0 +1,206 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package elfcore
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// maxKept limits the size of a range of a streamed core file kept in memory.
+const maxKept = 64 << 20
+
+var errNotKept = errors.New("this part of the core file is not kept")
+
+// ParseStream reads the metadata from a core file streamed from r in one pass,
+// e.g. while it is piped from the kernel and compressed. Only the headers, the
+// notes and the memory the metadata is read from are kept in memory. This works
+// because the kernel writes the notes before the memory of the process.
+// r is always read to the end.
+func ParseStream(r io.Reader) (*Metadata, error) {
+	s := &stream{r: r, kept: &sparseFile{}}
+	defer io.Copy(ioutil.Discard, r)
+
+	// the ELF header, then the program headers
+	if err := s.keep(0, elf.EI_NIDENT+48); err != nil {
+		return nil, fmt.Errorf("failed to read the ELF header: %v", err)
+	}
+	phoff, phsize, err := programHeaders(s.kept.chunks[0].data)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.keep(phoff, phoff+phsize); err != nil {
+		return nil, fmt.Errorf("failed to read the program headers: %v", err)
+	}
+	f, err := elf.NewFile(s.kept)
+	if err != nil {
+		return nil, err
+	}
+	progs := append([]*elf.Prog(nil), f.Progs...)
+	sort.Slice(progs, func(i, j int) bool { return progs[i].Off < progs[j].Off })
+	for _, prog := range progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		if int64(prog.Off) < s.pos || prog.Filesz > maxKept {
+			return nil, fmt.Errorf("the notes at %#x are not in front of the memory", prog.Off)
+		}
+		if err := s.keep(int64(prog.Off), int64(prog.Off+prog.Filesz)); err != nil {
+			return nil, fmt.Errorf("failed to read notes: %v", err)
+		}
+	}
+
+	// the memory is not kept yet, so this only finds out which memory to keep
+	m, err := Parse(s.kept)
+	if err != nil {
+		return nil, err
+	}
+	ranges := memoryRanges(f, m)
+	for _, rg := range ranges {
+		if err := s.keep(rg[0], rg[1]); err != nil {
+			// the core may be truncated, the metadata is complete without the memory
+			break
+		}
+	}
+	return Parse(s.kept)
+}
+
+// programHeaders returns the offset and the total size of the program headers
+// from the ELF header.
+func programHeaders(header []byte) (off, size int64, err error) {
+	if string(header[:4]) != elf.ELFMAG {
+		return 0, 0, fmt.Errorf("bad magic number %v", header[:4])
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(header[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	if elf.Class(header[elf.EI_CLASS]) == elf.ELFCLASS64 {
+		off = int64(order.Uint64(header[32:]))
+		size = int64(order.Uint16(header[54:])) * int64(order.Uint16(header[56:]))
+	} else {
+		off = int64(order.Uint32(header[28:]))
+		size = int64(order.Uint16(header[42:])) * int64(order.Uint16(header[44:]))
+	}
+	return off, size, nil
+}
+
+// memoryRanges returns the ranges of the core file holding the memory the metadata
+// is read from: the first page of the mapped files and the path of the executable.
+// They are sorted by offset.
+func memoryRanges(f *elf.File, m *Metadata) [][2]int64 {
+	pageSize := m.Auxv["AT_PAGESZ"]
+	if pageSize == 0 {
+		pageSize = 4096
+	}
+	var addrs [][2]uint64
+	for _, file := range m.Files {
+		if file.Offset == 0 {
+			end := file.Start + pageSize
+			if end > file.End {
+				end = file.End
+			}
+			addrs = append(addrs, [2]uint64{file.Start, end})
+		}
+	}
+	if addr, ok := m.Auxv["AT_EXECFN"]; ok {
+		addrs = append(addrs, [2]uint64{addr, addr + 4096})
+	}
+
+	var ranges [][2]int64
+	for _, addr := range addrs {
+		for _, prog := range f.Progs {
+			if prog.Type != elf.PT_LOAD || addr[1] <= prog.Vaddr || addr[0] >= prog.Vaddr+prog.Filesz {
+				continue
+			}
+			start, end := addr[0], addr[1]
+			if start < prog.Vaddr {
+				start = prog.Vaddr
+			}
+			if end > prog.Vaddr+prog.Filesz {
+				end = prog.Vaddr + prog.Filesz
+			}
+			ranges = append(ranges, [2]int64{int64(prog.Off + start - prog.Vaddr), int64(prog.Off + end - prog.Vaddr)})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	return ranges
+}
+
+// stream reads a core file forwards and keeps parts of it.
+type stream struct {
+	r    io.Reader
+	pos  int64
+	kept *sparseFile
+}
+
+// keep reads the file up to end, and keeps what is from off on. What has been
+// read already is skipped.
+func (s *stream) keep(off, end int64) error {
+	if off < s.pos {
+		off = s.pos
+	}
+	if end <= off {
+		return nil
+	}
+	if end-off > maxKept {
+		return fmt.Errorf("%d bytes are too many to keep", end-off)
+	}
+	if off > s.pos {
+		n, err := io.CopyN(ioutil.Discard, s.r, off-s.pos)
+		s.pos += n
+		if err != nil {
+			return err
+		}
+	}
+	data := make([]byte, end-off)
+	n, err := io.ReadFull(s.r, data)
+	s.kept.add(off, data[:n])
+	s.pos += int64(n)
+	return err
+}
+
+// sparseFile is a file of which only some parts are known.
+type sparseFile struct {
+	chunks []chunk
+}
+
+type chunk struct {
+	off  int64
+	data []byte
+}
+
+// add adds the data at off. It must be after all the data added before.
+func (s *sparseFile) add(off int64, data []byte) {
+	if n := len(s.chunks); n != 0 && s.chunks[n-1].off+int64(len(s.chunks[n-1].data)) == off {
+		s.chunks[n-1].data = append(s.chunks[n-1].data, data...)
+		return
+	}
+	s.chunks = append(s.chunks, chunk{off: off, data: data})
+}
+
+func (s *sparseFile) ReadAt(p []byte, off int64) (int, error) {
+	for _, c := range s.chunks {
+		if off >= c.off && off+int64(len(p)) <= c.off+int64(len(c.data)) {
+			return copy(p, c.data[off-c.off:]), nil
+		}
+	}
+	return 0, errNotKept
+}
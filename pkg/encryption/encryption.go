@@ -0,0 +1,215 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption encrypts core files with AES-256-GCM while they are written.
+//
+// A file starts with a magic string and a random salt. The data is then sealed in
+// chunks of 64KiB with a key derived from the salt and the key of the namespace.
+// The nonce of a chunk is its number and whether it is the last one, so chunks
+// can't be reordered, dropped or cut off without the decryption failing.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// KeySize is the size of the keys in bytes.
+	KeySize = 32
+	// Extension is the file name extension of encrypted files.
+	Extension = ".enc"
+
+	saltSize  = 32
+	chunkSize = 64 << 10
+)
+
+var magic = []byte("coredump-aes-256-gcm-v1\n")
+
+// ValidateKey checks that key can be used to encrypt.
+func ValidateKey(key []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("the key is %d bytes, expect %d bytes", len(key), KeySize)
+	}
+	return nil
+}
+
+// newAEAD returns the cipher of the file with salt.
+func newAEAD(key, salt []byte) (cipher.AEAD, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(magic)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce of chunk n.
+func nonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type writer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+	err  error
+}
+
+// NewWriter returns a writer encrypting into w with key. Closing it writes the last
+// chunk, but does not close w.
+func NewWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte{}, magic...), salt...)); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed when more data follows, as the last chunk is marked
+		if len(w.buf) == chunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) seal(last bool) error {
+	_, err := w.w.Write(w.aead.Seal(nil, nonce(w.n, last), w.buf, nil))
+	w.buf = w.buf[:0]
+	w.n++
+	return err
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.seal(true)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("encryption: write to a closed writer")
+	return nil
+}
+
+type reader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	// buf holds a sealed chunk and the first byte after it.
+	buf   []byte
+	plain []byte
+	n     uint64
+	done  bool
+}
+
+// NewReader returns a reader decrypting r with key.
+func NewReader(key []byte, r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(magic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("encryption: failed to read the header: %v", err)
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, errors.New("encryption: not an encrypted file")
+	}
+	aead, err := newAEAD(key, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	return &reader{r: r, aead: aead, buf: make([]byte, 0, chunkSize+aead.Overhead()+1)}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. It is the last one when nothing follows it.
+func (r *reader) open() error {
+	sealed := chunkSize + r.aead.Overhead()
+	n, err := io.ReadFull(r.r, r.buf[len(r.buf):sealed+1])
+	r.buf = r.buf[:len(r.buf)+n]
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+		sealed = len(r.buf)
+	default:
+		return err
+	}
+	plain, err := r.aead.Open(nil, nonce(r.n, last), r.buf[:sealed], nil)
+	if err != nil {
+		return errors.New("encryption: the file is corrupted, truncated or encrypted with another key")
+	}
+	r.plain = plain
+	r.n++
+	r.done = last
+	// keep the first byte of the next chunk
+	r.buf = append(r.buf[:0], r.buf[sealed:]...)
+	return nil
+}
+
+// TrimExtension removes Extension from name.
+func TrimExtension(name string) string {
+	return strings.TrimSuffix(name, Extension)
+}
@@ -0,0 +1,115 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encrypt(t *testing.T, key, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(key, &buf)
+	require.Nil(t, err)
+	// odd writes cross the chunks
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		written, err := w.Write(data[:n])
+		require.Nil(t, err)
+		require.Equal(t, n, written)
+		data = data[n:]
+	}
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func decrypt(key, data []byte) ([]byte, error) {
+	r, err := NewReader(key, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	random := make([]byte, 3*chunkSize+5)
+	rand.New(rand.NewSource(1)).Read(random)
+	testCases := [][]byte{
+		{},
+		[]byte("core of the crashed process"),
+		random[:chunkSize],
+		random[:2*chunkSize],
+		random,
+	}
+	for i, data := range testCases {
+		encrypted := encrypt(t, key, data)
+		assert.False(t, len(data) > 16 && bytes.Contains(encrypted, data[:16]), "test %d: not encrypted", i)
+		decrypted, err := decrypt(key, encrypted)
+		require.Nil(t, err, "test %d", i)
+		assert.Equal(t, len(data), len(decrypted), "test %d", i)
+		assert.True(t, bytes.Equal(data, decrypted), "test %d", i)
+	}
+
+	// the same data is encrypted differently every time
+	assert.NotEqual(t, encrypt(t, key, random), encrypt(t, key, random))
+}
+
+func TestDecryptionFailure(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	data := make([]byte, 2*chunkSize+5)
+	encrypted := encrypt(t, key, data)
+	header := len(magic) + saltSize
+	sealed := chunkSize + 16
+
+	otherKey := bytes.Repeat([]byte{2}, KeySize)
+	modified := append([]byte{}, encrypted...)
+	modified[header+sealed+10] ^= 1
+	swapped := append([]byte{}, encrypted[:header]...)
+	swapped = append(swapped, encrypted[header+sealed:header+2*sealed]...)
+	swapped = append(swapped, encrypted[header:header+sealed]...)
+	swapped = append(swapped, encrypted[header+2*sealed:]...)
+	testCases := []struct {
+		key  []byte
+		data []byte
+	}{
+		{key: otherKey, data: encrypted},
+		{key: key, data: modified},
+		{key: key, data: swapped},
+		// cut off after a chunk
+		{key: key, data: encrypted[:header+sealed]},
+		{key: key, data: encrypted[:header+2*sealed]},
+		{key: key, data: encrypted[:len(encrypted)-1]},
+		{key: key, data: encrypted[:header]},
+		{key: key, data: encrypted[:10]},
+		{key: key, data: []byte("core of the crashed process, not encrypted")},
+		{key: key[:16], data: encrypted},
+	}
+	for i, tc := range testCases {
+		_, err := decrypt(tc.key, tc.data)
+		assert.NotNil(t, err, "test %d", i)
+	}
+
+	_, err := NewWriter(key[:16], &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
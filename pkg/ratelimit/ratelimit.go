@@ -0,0 +1,138 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ratelimit limits events of the same key across processes, e.g. the
+// core dumps of a crash looping container, each of which is handled by a new
+// process. The times of the recent events of every key are kept in a file,
+// together with the number of the events denied since the key was last quiet.
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Limiter allows Burst events of every key in Interval. A Limiter with a zero
+// Burst or Interval allows everything.
+type Limiter struct {
+	// Dir keeps a file for every key.
+	Dir string
+	// Burst is the number of events of a key allowed in Interval.
+	Burst int
+	// Interval is the sliding window the events are counted in.
+	Interval time.Duration
+}
+
+// deniedPrefix starts the line counting the denied events in the file of a key.
+const deniedPrefix = "denied "
+
+// Allow reports whether an event of key at now is allowed, and counts it either way.
+// denied is the number of the events of key denied since no event of key was
+// allowed in Interval, this one included.
+// Concurrent callers are serialized by a lock on the file of key.
+func (l *Limiter) Allow(key string, now time.Time) (allowed bool, denied int, err error) {
+	if l.Burst <= 0 || l.Interval <= 0 {
+		return true, 0, nil
+	}
+	if len(key) == 0 || strings.ContainsAny(key, "/\x00") || key == "." || key == ".." {
+		return false, 0, fmt.Errorf("invalid key %q", key)
+	}
+	if err := os.MkdirAll(l.Dir, 0700); err != nil {
+		return false, 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(l.Dir, key), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return false, 0, &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+
+	var recent []time.Time
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, deniedPrefix) {
+			denied, _ = strconv.Atoi(strings.TrimPrefix(line, deniedPrefix))
+			continue
+		}
+		nsec, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			// ignore what we didn't write
+			continue
+		}
+		if t := time.Unix(0, nsec); now.Sub(t) < l.Interval {
+			recent = append(recent, t)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, 0, err
+	}
+	if len(recent) == 0 {
+		// the key was quiet
+		denied = 0
+	}
+	allowed = len(recent) < l.Burst
+	if allowed {
+		recent = append(recent, now)
+	} else {
+		denied++
+	}
+
+	var buf strings.Builder
+	for _, t := range recent {
+		fmt.Fprintf(&buf, "%d\n", t.UnixNano())
+	}
+	if denied > 0 {
+		fmt.Fprintf(&buf, "%s%d\n", deniedPrefix, denied)
+	}
+	if err := f.Truncate(0); err != nil {
+		return false, 0, err
+	}
+	if _, err := f.WriteAt([]byte(buf.String()), 0); err != nil {
+		return false, 0, err
+	}
+	return allowed, denied, f.Close()
+}
+
+// Prune removes the files of the keys without events in Interval before now.
+func (l *Limiter) Prune(now time.Time) error {
+	if l.Interval <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() && now.Sub(file.ModTime()) >= l.Interval {
+			if err := os.Remove(filepath.Join(l.Dir, file.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
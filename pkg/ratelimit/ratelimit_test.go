@@ -0,0 +1,98 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l := &Limiter{Dir: filepath.Join(dir, "state"), Burst: 2, Interval: time.Hour}
+	now := time.Unix(1539000000, 0)
+	testCases := []struct {
+		key            string
+		now            time.Time
+		expected       bool
+		expectedDenied int
+	}{
+		{key: "a", now: now, expected: true},
+		{key: "a", now: now.Add(time.Minute), expected: true},
+		{key: "a", now: now.Add(2 * time.Minute), expected: false, expectedDenied: 1},
+		{key: "a", now: now.Add(3 * time.Minute), expected: false, expectedDenied: 2},
+		// other keys are counted on their own
+		{key: "b", now: now.Add(2 * time.Minute), expected: true},
+		// the first event is out of the window, denied events don't take room in it
+		{key: "a", now: now.Add(time.Hour), expected: true, expectedDenied: 2},
+		{key: "a", now: now.Add(time.Hour + time.Second), expected: false, expectedDenied: 3},
+		// the key was quiet for an hour
+		{key: "a", now: now.Add(2*time.Hour + time.Minute), expected: true},
+		{key: "a", now: now.Add(2*time.Hour + 2*time.Minute), expected: true},
+		{key: "a", now: now.Add(2*time.Hour + 3*time.Minute), expected: false, expectedDenied: 1},
+	}
+	for i, tc := range testCases {
+		allowed, denied, err := l.Allow(tc.key, tc.now)
+		require.Nil(t, err, "test %d", i)
+		assert.Equal(t, tc.expected, allowed, "test %d", i)
+		assert.Equal(t, tc.expectedDenied, denied, "test %d", i)
+	}
+
+	for _, key := range []string{"", ".", "..", "a/b"} {
+		_, _, err := l.Allow(key, now)
+		assert.NotNil(t, err, "key %q", key)
+	}
+
+	unlimited := &Limiter{Dir: filepath.Join(dir, "unlimited")}
+	for i := 0; i < 10; i++ {
+		allowed, denied, err := unlimited.Allow("a", now)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, 0, denied)
+	}
+	_, err = os.Stat(unlimited.Dir)
+	assert.True(t, os.IsNotExist(err), "state is kept without limits")
+}
+
+func TestLimiterPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l := &Limiter{Dir: dir, Burst: 1, Interval: time.Hour}
+	now := time.Now()
+	for _, key := range []string{"old", "new"} {
+		_, _, err := l.Allow(key, now)
+		require.Nil(t, err)
+	}
+	require.Nil(t, os.Chtimes(filepath.Join(dir, "old"), now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+
+	require.Nil(t, l.Prune(now))
+	_, err = os.Stat(filepath.Join(dir, "old"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "new"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, (&Limiter{Dir: filepath.Join(dir, "missing"), Burst: 1, Interval: time.Hour}).Prune(now))
+}
@@ -0,0 +1,264 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retention decides which core files to delete from a claim, laid out as
+// `<pod name>/<container name>/<core file>` by the coredump-detector webhook.
+package retention
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// sidecarSuffixes are the suffixes of the files which belong to the core file
+// with the rest of their name, such as the metadata written by `coredump-detector handle`.
+var sidecarSuffixes = []string{".json", ".json.enc"}
+
+// Policy limits the core files kept. A zero limit is unlimited.
+type Policy struct {
+	// MaxAge is how long a core file is kept.
+	MaxAge time.Duration
+	// MaxCount is the number of core files kept for every container.
+	MaxCount int
+	// MaxBytesPerContainer is the total size of the core files kept for every container.
+	MaxBytesPerContainer int64
+	// MaxBytesPerPod is the total size of the core files kept for every pod.
+	MaxBytesPerPod int64
+	// MaxBytesPerNamespace is the total size of all the core files kept in the claim.
+	// It is only read from the default policy.
+	MaxBytesPerNamespace int64
+}
+
+// File is a core file together with its sidecar files.
+type File struct {
+	Path      string
+	Pod       string
+	Container string
+	// Size is the size of the core file and its sidecar files.
+	Size    int64
+	ModTime time.Time
+	// Sidecars are the paths of the sidecar files.
+	Sidecars []string
+}
+
+// Deletion is a file to delete and why.
+type Deletion struct {
+	File
+	Reason string
+}
+
+// Scan lists the core files under root, oldest first.
+func Scan(root string) ([]File, error) {
+	var files []File
+	pods, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if !pod.IsDir() {
+			continue
+		}
+		containers, err := ioutil.ReadDir(filepath.Join(root, pod.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range containers {
+			if !container.IsDir() {
+				continue
+			}
+			dir := filepath.Join(root, pod.Name(), container.Name())
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, scanContainer(dir, pod.Name(), container.Name(), infos)...)
+		}
+	}
+	sortOldestFirst(files)
+	return files, nil
+}
+
+// scanContainer groups the regular files of a container directory into core files and their sidecars.
+func scanContainer(dir, pod, container string, infos []os.FileInfo) []File {
+	regular := map[string]os.FileInfo{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			regular[info.Name()] = info
+		}
+	}
+	var files []File
+	for name, info := range regular {
+		if isSidecar(name, regular) {
+			continue
+		}
+		f := File{
+			Path:      filepath.Join(dir, name),
+			Pod:       pod,
+			Container: container,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+		}
+		for _, suffix := range sidecarSuffixes {
+			if sidecar, ok := regular[name+suffix]; ok {
+				f.Sidecars = append(f.Sidecars, filepath.Join(dir, name+suffix))
+				f.Size += sidecar.Size()
+			}
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func isSidecar(name string, regular map[string]os.FileInfo) bool {
+	for _, suffix := range sidecarSuffixes {
+		if _, ok := regular[strings.TrimSuffix(name, suffix)]; ok && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortOldestFirst(files []File) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].ModTime.Equal(files[j].ModTime) {
+			return files[i].ModTime.Before(files[j].ModTime)
+		}
+		return files[i].Path < files[j].Path
+	})
+}
+
+// Plan returns the files to delete, so that what remains satisfies the policy of
+// every pod. The policy of a pod is taken from pods by the pod name, and is
+// defaults if it is not there. The oldest files are deleted first.
+func Plan(files []File, defaults Policy, pods map[string]Policy, now time.Time) []Deletion {
+	files = append([]File(nil), files...)
+	sortOldestFirst(files)
+	policy := func(pod string) Policy {
+		if p, ok := pods[pod]; ok {
+			return p
+		}
+		return defaults
+	}
+
+	var deletions []Deletion
+	deleted := map[string]bool{}
+	remove := func(f File, reason string) {
+		deleted[f.Path] = true
+		deletions = append(deletions, Deletion{File: f, Reason: reason})
+	}
+	remaining := func(filter func(File) bool) []File {
+		var result []File
+		for _, f := range files {
+			if !deleted[f.Path] && filter(f) {
+				result = append(result, f)
+			}
+		}
+		return result
+	}
+	// trim deletes the oldest of group until at most maxCount files of at most maxBytes are left.
+	trim := func(group []File, maxCount int, maxBytes int64, reason string) {
+		var total int64
+		for _, f := range group {
+			total += f.Size
+		}
+		count := len(group)
+		for _, f := range group {
+			if (maxCount == 0 || count <= maxCount) && (maxBytes == 0 || total <= maxBytes) {
+				return
+			}
+			remove(f, reason)
+			count--
+			total -= f.Size
+		}
+	}
+
+	for _, f := range files {
+		if p := policy(f.Pod); p.MaxAge != 0 && now.Sub(f.ModTime) > p.MaxAge {
+			remove(f, fmt.Sprintf("older than %s", p.MaxAge))
+		}
+	}
+
+	type key struct{ pod, container string }
+	var containers []key
+	seen := map[key]bool{}
+	for _, f := range files {
+		k := key{f.Pod, f.Container}
+		if !seen[k] {
+			seen[k] = true
+			containers = append(containers, k)
+		}
+	}
+	for _, k := range containers {
+		p := policy(k.pod)
+		group := remaining(func(f File) bool { return f.Pod == k.pod && f.Container == k.container })
+		trim(group, p.MaxCount, 0, fmt.Sprintf("more than %d files in container %s of pod %s", p.MaxCount, k.container, k.pod))
+		group = remaining(func(f File) bool { return f.Pod == k.pod && f.Container == k.container })
+		trim(group, 0, p.MaxBytesPerContainer, fmt.Sprintf("more than %d bytes in container %s of pod %s", p.MaxBytesPerContainer, k.container, k.pod))
+	}
+
+	podSeen := map[string]bool{}
+	for _, k := range containers {
+		if podSeen[k.pod] {
+			continue
+		}
+		podSeen[k.pod] = true
+		p := policy(k.pod)
+		group := remaining(func(f File) bool { return f.Pod == k.pod })
+		trim(group, 0, p.MaxBytesPerPod, fmt.Sprintf("more than %d bytes in pod %s", p.MaxBytesPerPod, k.pod))
+	}
+
+	group := remaining(func(File) bool { return true })
+	trim(group, 0, defaults.MaxBytesPerNamespace, fmt.Sprintf("more than %d bytes in the namespace", defaults.MaxBytesPerNamespace))
+	return deletions
+}
+
+// Delete removes the files of deletions with their sidecar files.
+func Delete(deletions []Deletion) error {
+	for _, d := range deletions {
+		for _, path := range append([]string{d.Path}, d.Sidecars...) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteReport writes a table of deletions to w. With dryRun the files are reported
+// as to be deleted rather than deleted.
+func WriteReport(w io.Writer, deletions []Deletion, dryRun bool, now time.Time) error {
+	verb := "deleted"
+	if dryRun {
+		verb = "would delete"
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tSIZE\tAGE\tREASON")
+	var total int64
+	for _, d := range deletions {
+		total += d.Size
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", d.Path, d.Size, now.Sub(d.ModTime).Truncate(time.Second), d.Reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %d files, %d bytes\n", verb, len(deletions), total)
+	return err
+}
@@ -0,0 +1,155 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retention
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2018, 10, 8, 12, 0, 0, 0, time.UTC)
+
+func file(pod, container, name string, size int64, age time.Duration) File {
+	return File{
+		Path:      filepath.Join(pod, container, name),
+		Pod:       pod,
+		Container: container,
+		Size:      size,
+		ModTime:   now.Add(-age),
+	}
+}
+
+func TestPlan(t *testing.T) {
+	files := []File{
+		file("pod1", "c1", "core_1", 100, 5*time.Hour),
+		file("pod1", "c1", "core_2", 100, 4*time.Hour),
+		file("pod1", "c1", "core_3", 100, 3*time.Hour),
+		file("pod1", "c2", "core_4", 300, 2*time.Hour),
+		file("pod2", "c1", "core_5", 100, 90*time.Minute),
+		file("pod2", "c1", "core_6", 100, time.Hour),
+	}
+	testCases := []struct {
+		name     string
+		defaults Policy
+		pods     map[string]Policy
+		expected []string
+	}{
+		{
+			name:     "unlimited",
+			expected: nil,
+		},
+		{
+			name:     "max age",
+			defaults: Policy{MaxAge: 150 * time.Minute},
+			expected: []string{"pod1/c1/core_1", "pod1/c1/core_2", "pod1/c1/core_3"},
+		},
+		{
+			name:     "max count",
+			defaults: Policy{MaxCount: 1},
+			expected: []string{"pod1/c1/core_1", "pod1/c1/core_2", "pod2/c1/core_5"},
+		},
+		{
+			name:     "max bytes per container",
+			defaults: Policy{MaxBytesPerContainer: 250},
+			expected: []string{"pod1/c1/core_1", "pod1/c2/core_4"},
+		},
+		{
+			name:     "max bytes per pod",
+			defaults: Policy{MaxBytesPerPod: 400},
+			expected: []string{"pod1/c1/core_1", "pod1/c1/core_2"},
+		},
+		{
+			name:     "max bytes per namespace",
+			defaults: Policy{MaxBytesPerNamespace: 350},
+			expected: []string{"pod1/c1/core_1", "pod1/c1/core_2", "pod1/c1/core_3", "pod1/c2/core_4"},
+		},
+		{
+			name:     "policy of a pod",
+			defaults: Policy{MaxCount: 1},
+			pods:     map[string]Policy{"pod2": {MaxAge: 80 * time.Minute}},
+			expected: []string{"pod2/c1/core_5", "pod1/c1/core_1", "pod1/c1/core_2"},
+		},
+		{
+			name:     "limits add up",
+			defaults: Policy{MaxAge: 270 * time.Minute, MaxCount: 2, MaxBytesPerPod: 300},
+			expected: []string{"pod1/c1/core_1", "pod1/c1/core_2", "pod1/c1/core_3"},
+		},
+	}
+
+	for _, tc := range testCases {
+		var paths []string
+		for _, d := range Plan(files, tc.defaults, tc.pods, now) {
+			assert.NotEmpty(t, d.Reason, tc.name)
+			paths = append(paths, d.Path)
+		}
+		assert.Equal(t, tc.expected, paths, tc.name)
+	}
+}
+
+func TestCleanupDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "retention")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	write := func(path, content string, age time.Duration) {
+		path = filepath.Join(root, path)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+		require.Nil(t, os.Chtimes(path, now.Add(-age), now.Add(-age)))
+	}
+	write("pod1/c1/core_a_1.1", "0123456789", 3*time.Hour)
+	write("pod1/c1/core_a_1.1.json", "{}", 3*time.Hour)
+	write("pod1/c1/core_a_2.2", "0123456789", 2*time.Hour)
+	write("pod1/c1/core_a_2.2.json.enc", "{}", 2*time.Hour)
+	write("pod1/c1/notes.json", "{}", time.Hour)
+	write("pod1/README", "not a container", time.Hour)
+
+	files, err := Scan(root)
+	require.Nil(t, err)
+	require.Len(t, files, 3)
+	assert.Equal(t, filepath.Join(root, "pod1/c1/core_a_1.1"), files[0].Path)
+	assert.Equal(t, int64(12), files[0].Size)
+	assert.Equal(t, []string{filepath.Join(root, "pod1/c1/core_a_1.1.json")}, files[0].Sidecars)
+	assert.Equal(t, filepath.Join(root, "pod1/c1/core_a_2.2"), files[1].Path)
+	assert.Equal(t, []string{filepath.Join(root, "pod1/c1/core_a_2.2.json.enc")}, files[1].Sidecars)
+	assert.Equal(t, filepath.Join(root, "pod1/c1/notes.json"), files[2].Path)
+
+	deletions := Plan(files, Policy{MaxAge: 150 * time.Minute}, nil, now)
+	require.Len(t, deletions, 1)
+
+	report := &bytes.Buffer{}
+	require.Nil(t, WriteReport(report, deletions, true, now))
+	assert.Contains(t, report.String(), "core_a_1.1  12    3h0m0s  older than 2h30m0s")
+	assert.Contains(t, report.String(), "would delete 1 files, 12 bytes")
+
+	require.Nil(t, Delete(deletions))
+	for path, exists := range map[string]bool{
+		"pod1/c1/core_a_1.1":          false,
+		"pod1/c1/core_a_1.1.json":     false,
+		"pod1/c1/core_a_2.2":          true,
+		"pod1/c1/core_a_2.2.json.enc": true,
+		"pod1/README":                 true,
+	} {
+		_, err := os.Stat(filepath.Join(root, path))
+		assert.Equal(t, exists, err == nil, path)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3 uploads files to S3 compatible object storage. The requests are path
+// style and signed with AWS Signature Version 4. Large files are uploaded in parts,
+// failed requests are retried, and the server checks every part against its MD5
+// and SHA-256 checksums.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MinPartSize is the smallest part but the last one of a multipart upload.
+	MinPartSize = 5 << 20
+	// DefaultPartSize is the part size of multipart uploads when Client.PartSize is not set.
+	DefaultPartSize = 16 << 20
+	// maxParts is the largest number of parts of a multipart upload.
+	maxParts = 10000
+)
+
+// Client uploads objects into the buckets of an S3 compatible service.
+type Client struct {
+	// Endpoint is the URL of the service, e.g. "https://s3.us-east-1.amazonaws.com".
+	// Buckets are addressed in the path of the requests.
+	Endpoint string
+	// Region is the region the requests are signed for, e.g. "us-east-1".
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials.
+	SessionToken string
+	// HTTPClient sends the requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// PartSize is the size of the parts of multipart uploads, at least MinPartSize.
+	// It is raised for files which would need more than 10000 parts.
+	// Files up to PartSize are uploaded with a single request. Defaults to DefaultPartSize.
+	PartSize int64
+	// Retries is how many times a failed request is retried.
+	Retries int
+	// Backoff is the wait before the first retry, doubled for every next one. Defaults to a second.
+	Backoff time.Duration
+}
+
+// Error is an error response of the service.
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// retryable reports whether the request may succeed when it is sent again.
+func (e *Error) retryable() bool {
+	switch e.Code {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Upload uploads the size bytes read from r to key in bucket.
+func (c *Client) Upload(ctx context.Context, bucket, key string, r io.Reader, size int64) error {
+	partSize := c.partSize(size)
+	if size <= partSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		_, _, err := c.do(ctx, http.MethodPut, bucket, key, nil, data)
+		return err
+	}
+
+	uploadID, err := c.createMultipartUpload(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	buf := make([]byte, partSize)
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+		n := partSize
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err = io.ReadFull(r, buf[:n]); err != nil {
+			break
+		}
+		var etag string
+		if etag, err = c.uploadPart(ctx, bucket, key, uploadID, number, buf[:n]); err != nil {
+			break
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+	}
+	if err == nil {
+		err = c.completeMultipartUpload(ctx, bucket, key, uploadID, parts)
+	}
+	if err != nil {
+		// the parts are kept and billed until the upload is aborted
+		if _, _, abortErr := c.do(ctx, http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil); abortErr != nil {
+			return fmt.Errorf("%v, and failed to abort upload %s: %v", err, uploadID, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Stat returns the size of key in bucket. ok is false when it doesn't exist.
+func (c *Client) Stat(ctx context.Context, bucket, key string) (size int64, ok bool, err error) {
+	resp, _, err := c.do(ctx, http.MethodHead, bucket, key, nil, nil)
+	if e, isError := err.(*Error); isError && e.StatusCode == http.StatusNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return resp.ContentLength, true, nil
+}
+
+func (c *Client) partSize(size int64) int64 {
+	partSize := c.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	if min := (size + maxParts - 1) / maxParts; partSize < min {
+		partSize = min
+	}
+	return partSize
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, bucket, key string) (string, error) {
+	_, body, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result initiateMultipartUploadResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("s3: invalid response to the creation of the multipart upload of %s: %v", key, err)
+	}
+	if len(result.UploadID) == 0 {
+		return "", fmt.Errorf("s3: no upload id in the response to the creation of the multipart upload of %s", key)
+	}
+	return result.UploadID, nil
+}
+
+func (c *Client) uploadPart(ctx context.Context, bucket, key, uploadID string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, _, err := c.do(ctx, http.MethodPut, bucket, key, query, data)
+	if err != nil {
+		return "", err
+	}
+	etag := resp.Header.Get("ETag")
+	if len(etag) == 0 {
+		return "", fmt.Errorf("s3: no ETag in the response to part %d of %s", number, key)
+	}
+	return etag, nil
+}
+
+func (c *Client) completeMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []completedPart) error {
+	data, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, data)
+	return err
+}
+
+// do sends a signed request with body to key in bucket and returns the response
+// with its body. Network errors, throttling and server errors are retried.
+func (c *Client) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	backoff := c.Backoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	for retry := 0; ; retry++ {
+		resp, respBody, err := c.send(ctx, method, bucket, key, query, body)
+		if err == nil {
+			return resp, respBody, nil
+		}
+		if e, ok := err.(*Error); (ok && !e.retryable()) || retry >= c.Retries {
+			return resp, respBody, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, bucket, key string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3: invalid endpoint %q: %v", c.Endpoint, err)
+	}
+	u := *endpoint
+	u.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if body == nil {
+		req.Body, req.ContentLength = nil, 0
+	}
+	payloadHash := sha256.Sum256(body)
+	if body != nil {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	if len(c.SessionToken) != 0 {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	signV4(req, c.AccessKeyID, c.SecretAccessKey, c.Region, hex.EncodeToString(payloadHash[:]), time.Now())
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	if resp.StatusCode/100 != 2 || isErrorDocument(respBody) {
+		// the completion of a multipart upload may fail after a 200 OK
+		e := &Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(respBody, e)
+		if resp.StatusCode/100 == 2 {
+			e.StatusCode = http.StatusInternalServerError
+		}
+		return resp, respBody, e
+	}
+	return resp, respBody, nil
+}
+
+// isErrorDocument reports whether body is an XML document with an Error root element.
+func isErrorDocument(body []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "Error"
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/compression"
+)
+
+// podTemplateResources are the workloads whose pod template is mutated when
+// --mutate-pod-templates is set.
+var podTemplateResources = map[metav1.GroupVersionResource]bool{
+	{Group: "apps", Version: "v1", Resource: "deployments"}:  true,
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: true,
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}:   true,
+	{Group: "apps", Version: "v1", Resource: "replicasets"}:  true,
+	{Group: "batch", Version: "v1", Resource: "jobs"}:        true,
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}:    true,
+}
+
+// sortedPodTemplateResources returns podTemplateResources ordered by group and resource.
+func sortedPodTemplateResources() []metav1.GroupVersionResource {
+	var resources []metav1.GroupVersionResource
+	for gvr := range podTemplateResources {
+		resources = append(resources, gvr)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Group != resources[j].Group {
+			return resources[i].Group < resources[j].Group
+		}
+		return resources[i].Resource < resources[j].Resource
+	})
+	return resources
+}
+
+// podTemplate returns the pod template of a workload, or nil if obj is not a supported workload.
+func podTemplate(obj runtime.Object) *corev1.PodTemplateSpec {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &o.Spec.Template
+	case *appsv1.StatefulSet:
+		return &o.Spec.Template
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template
+	case *appsv1.ReplicaSet:
+		return &o.Spec.Template
+	case *batchv1.Job:
+		return &o.Spec.Template
+	case *batchv1.CronJob:
+		return &o.Spec.JobTemplate.Spec.Template
+	}
+	return nil
+}
+
+// mutatePodTemplate does the same thing as mutatePod, but to the pod template of a workload.
+// The annotation is read from the workload itself rather than from the pod template, so the
+// pods created from the mutated template are left alone by mutatePod.
+// Because the change is part of the workload, `kubectl apply` sees it in the live object.
+// Updates are mutated like creations, so that the annotation can be added to an existing
+// workload, and a `kubectl replace` of the workload keeps the volume. The mutation is
+// idempotent, so the updates of mutated workloads are left as they are. The updates of
+// Jobs are allowed untouched, because the pod template of a Job is immutable.
+func mutatePodTemplate(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	glog.V(2).Info("mutating pod templates")
+
+	// check the resource
+	if ar.Request == nil || !podTemplateResources[ar.Request.Resource] {
+		glog.Errorf("unexpected resource, expect one of %v", podTemplateResources)
+		return nil
+	}
+
+	// check the verb
+	if ar.Request.Operation != admissionv1.Create && ar.Request.Operation != admissionv1.Update {
+		glog.Errorf("expect operation to be %s or %s", admissionv1.Create, admissionv1.Update)
+		return nil
+	}
+
+	raw := ar.Request.Object.Raw
+	deserializer := codecs.UniversalDeserializer()
+	obj, _, err := deserializer.Decode(raw, nil, nil)
+	if err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	if podTemplate(obj) == nil {
+		err := fmt.Errorf("unexpected object type %T", obj)
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	if _, ok := obj.(*batchv1.Job); ok && ar.Request.Operation == admissionv1.Update {
+		return allowAdmissionResponse()
+	}
+
+	metadataAccessor := meta.NewAccessor()
+	annots, err := metadataAccessor.Annotations(obj)
+	if err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+
+	volume, err := coredumpVolume(ar.Request.Namespace, annots)
+	if err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonInvalidAnnotation)
+	}
+	if volume == nil {
+		// no key set, we do nothing
+		return allowAdmissionResponse()
+	}
+
+	algorithm, err := compression.Parse(annots[compressionAnnotation])
+	if err != nil {
+		return rejectAdmissionResponse(fmt.Errorf("invalid annotation %s: %v", compressionAnnotation, err), http.StatusBadRequest, reasonInvalidAnnotation)
+	}
+	containers, err := parseContainerFilter(annots)
+	if err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonInvalidAnnotation)
+	}
+	newObj := obj.DeepCopyObject()
+	if err := injectCoredumpVolume(&podTemplate(newObj).Spec, *volume, algorithm, containers); err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonMountConflict)
+	}
+	if err := scheduleToCoredumpNodes(&podTemplate(newObj).Spec); err != nil {
+		return rejectAdmissionResponse(err, http.StatusBadRequest, reasonSchedulingConflict)
+	}
+
+	return patchAdmissionResponse(raw, newObj)
+}
@@ -0,0 +1,201 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var annotatedObjectMeta = metav1.ObjectMeta{
+	Name: "workload1",
+	Annotations: map[string]string{
+		"coredump.fujitsu.com/pvcname": "pvc1",
+	},
+}
+
+var podTemplateSpec = corev1.PodTemplateSpec{
+	Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "container1",
+			},
+		},
+	},
+}
+
+type podTemplateTestCase struct {
+	resource         metav1.GroupVersionResource
+	object           runtime.Object
+	mutateTemplates  bool
+	expectedResponse *admissionv1.AdmissionResponse
+}
+
+var podTemplateTestCases = []podTemplateTestCase{
+	{
+		// deployment template is mutated
+		resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		object: &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: annotatedObjectMeta,
+			Spec:       appsv1.DeploymentSpec{Template: podTemplateSpec},
+		},
+		mutateTemplates: true,
+		expectedResponse: &admissionv1.AdmissionResponse{
+			Allowed:   true,
+			PatchType: &patchTypeV1,
+			Patch:     []byte(`[{"op":"add","path":"/spec/template/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/template/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/template/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+		},
+	},
+	{
+		// cronjob template is mutated
+		resource: metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"},
+		object: &batchv1.CronJob{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"},
+			ObjectMeta: annotatedObjectMeta,
+			Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{
+					Spec: batchv1.JobSpec{Template: podTemplateSpec},
+				},
+			},
+		},
+		mutateTemplates: true,
+		expectedResponse: &admissionv1.AdmissionResponse{
+			Allowed:   true,
+			PatchType: &patchTypeV1,
+			Patch:     []byte(`[{"op":"add","path":"/spec/jobTemplate/spec/template/spec/containers/0/env","value":[{"name":"COREDUMP_POD_NAME","valueFrom":{"fieldRef":{"apiVersion":"v1","fieldPath":"metadata.name"}}}]},{"op":"add","path":"/spec/jobTemplate/spec/template/spec/containers/0/volumeMounts","value":[{"mountPath":"/var/coredump","name":"coredump","subPathExpr":"$(COREDUMP_POD_NAME)/container1"}]},{"op":"add","path":"/spec/jobTemplate/spec/template/spec/nodeSelector","value":{"coredump":"true"}},{"op":"add","path":"/spec/jobTemplate/spec/template/spec/volumes","value":[{"name":"coredump","persistentVolumeClaim":{"claimName":"pvc1"}}]}]`),
+		},
+	},
+	{
+		// annotation on the pod template only, we do nothing
+		resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"},
+		object: &appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: metav1.ObjectMeta{Name: "workload1"},
+			Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: annotatedObjectMeta,
+				Spec:       podTemplateSpec.Spec,
+			}},
+		},
+		mutateTemplates: true,
+		expectedResponse: &admissionv1.AdmissionResponse{
+			Allowed: true,
+		},
+	},
+	{
+		// mutating pod templates is disabled, we do nothing
+		resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		object: &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: annotatedObjectMeta,
+			Spec:       appsv1.DeploymentSpec{Template: podTemplateSpec},
+		},
+		mutateTemplates:  false,
+		expectedResponse: nil,
+	},
+}
+
+func TestMutatePodTemplate(t *testing.T) {
+	defer func() { options.MutatePodTemplates = false }()
+	for i, tc := range podTemplateTestCases {
+		options.MutatePodTemplates = tc.mutateTemplates
+		raw, err := runtime.Encode(jsonSerializer, tc.object)
+		if err != nil {
+			t.Fatalf("test[%d] fatal: %v", i, err)
+		}
+		response := mutate(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{
+				Resource:  tc.resource,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		assert.Equal(t, tc.expectedResponse, response, fmt.Sprintf("test %d: unexpected response", i))
+	}
+}
+
+func TestMutatePodTemplateUpdate(t *testing.T) {
+	defer func() { options.MutatePodTemplates = false }()
+	options.MutatePodTemplates = true
+	resource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	// the annotation is added to an existing deployment by `kubectl apply`
+	oldRaw, err := runtime.Encode(jsonSerializer, &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "workload1"},
+		Spec:       appsv1.DeploymentSpec{Template: podTemplateSpec},
+	})
+	require.Nil(t, err)
+	raw, err := runtime.Encode(jsonSerializer, podTemplateTestCases[0].object)
+	require.Nil(t, err)
+
+	var patches []string
+	for round := 0; round < 2; round++ {
+		response := mutate(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{
+				Resource:  resource,
+				Operation: admissionv1.Update,
+				Object:    runtime.RawExtension{Raw: raw},
+				OldObject: runtime.RawExtension{Raw: oldRaw},
+			},
+		})
+		require.NotNil(t, response, "round %d: no response", round)
+		require.True(t, response.Allowed, "round %d: rejected: %v", round, response.Result)
+		patches = append(patches, string(response.Patch))
+
+		patch, err := jsonpatch.DecodePatch(response.Patch)
+		require.Nil(t, err, "round %d: invalid patch", round)
+		oldRaw = raw
+		raw, err = patch.Apply(raw)
+		require.Nil(t, err, "round %d: failed to apply patch", round)
+	}
+	assert.Equal(t, string(podTemplateTestCases[0].expectedResponse.Patch), patches[0], "the update should be mutated like a creation")
+	assert.Equal(t, "[]", patches[1], "the update of a mutated deployment should not change it")
+}
+
+func TestMutatePodTemplateJobUpdate(t *testing.T) {
+	defer func() { options.MutatePodTemplates = false }()
+	options.MutatePodTemplates = true
+
+	job := &batchv1.Job{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: annotatedObjectMeta,
+		Spec:       batchv1.JobSpec{Template: podTemplateSpec},
+	}
+	raw, err := runtime.Encode(jsonSerializer, job)
+	require.Nil(t, err)
+
+	response := mutate(admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			Resource:  metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"},
+			Operation: admissionv1.Update,
+			Object:    runtime.RawExtension{Raw: raw},
+			OldObject: runtime.RawExtension{Raw: raw},
+		},
+	})
+	require.NotNil(t, response)
+	assert.True(t, response.Allowed, "the update of a job should be allowed: %v", response.Result)
+	assert.Empty(t, response.Patch, "the pod template of a job is immutable")
+}
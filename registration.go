@@ -0,0 +1,190 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RegistrationOptions contains the options to register the webhook in kube-apiserver
+// by creating a MutatingWebhookConfiguration at startup.
+type RegistrationOptions struct {
+	Register bool
+	// Unregister deletes the MutatingWebhookConfiguration on shutdown.
+	Unregister        bool
+	Name              string
+	CABundleFile      string
+	ServiceName       string
+	ServiceNamespace  string
+	ServicePort       int32
+	URL               string
+	FailurePolicy     string
+	NamespaceSelector string
+}
+
+func (o *RegistrationOptions) addFlags() {
+	pflag.BoolVar(&o.Register, "register-webhook", o.Register, ""+
+		"Create or update the MutatingWebhookConfiguration of the webhook at startup.")
+	pflag.BoolVar(&o.Unregister, "unregister-webhook-on-shutdown", o.Unregister, ""+
+		"Delete the MutatingWebhookConfiguration when the webhook is shut down.")
+	pflag.StringVar(&o.Name, "webhook-config-name", o.Name, "Name of the MutatingWebhookConfiguration.")
+	pflag.StringVar(&o.CABundleFile, "webhook-ca-bundle-file", o.CABundleFile, ""+
+		"File containing the CA which signed --tls-cert-file, set as caBundle of the webhook. "+
+		"Required with --register-webhook. The webhook is registered again when it changes.")
+	pflag.StringVar(&o.ServiceName, "webhook-service-name", o.ServiceName, ""+
+		"Name of the service in front of the webhook. Either this or --webhook-url is required.")
+	pflag.StringVar(&o.ServiceNamespace, "webhook-service-namespace", o.ServiceNamespace, "Namespace of the service.")
+	pflag.Int32Var(&o.ServicePort, "webhook-service-port", o.ServicePort, "Port of the service.")
+	pflag.StringVar(&o.URL, "webhook-url", o.URL, ""+
+		"URL kube-apiserver uses to reach the webhook when it runs outside of the cluster.")
+	pflag.StringVar(&o.FailurePolicy, "webhook-failure-policy", o.FailurePolicy, ""+
+		"Failure policy of the webhook, Ignore or Fail.")
+	pflag.StringVar(&o.NamespaceSelector, "webhook-namespace-selector", o.NamespaceSelector, ""+
+		"Label selector of the namespaces whose pods are sent to the webhook, e.g. 'coredump notin (disabled)'. "+
+		"Pods of all namespaces are sent when it is empty.")
+}
+
+// mutatingWebhookConfiguration builds the MutatingWebhookConfiguration described by the options.
+func (o *RegistrationOptions) mutatingWebhookConfiguration(mutatePodTemplates bool) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	if len(o.CABundleFile) == 0 {
+		return nil, fmt.Errorf("--webhook-ca-bundle-file is required")
+	}
+	caBundle, err := ioutil.ReadFile(o.CABundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := admissionregistrationv1.WebhookClientConfig{CABundle: caBundle}
+	switch {
+	case len(o.ServiceName) != 0 && len(o.URL) != 0:
+		return nil, fmt.Errorf("only one of --webhook-service-name and --webhook-url can be set")
+	case len(o.ServiceName) != 0:
+		port := o.ServicePort
+		clientConfig.Service = &admissionregistrationv1.ServiceReference{
+			Namespace: o.ServiceNamespace,
+			Name:      o.ServiceName,
+			Port:      &port,
+		}
+	case len(o.URL) != 0:
+		url := o.URL
+		clientConfig.URL = &url
+	default:
+		return nil, fmt.Errorf("one of --webhook-service-name and --webhook-url is required")
+	}
+
+	failurePolicy := admissionregistrationv1.FailurePolicyType(o.FailurePolicy)
+	if failurePolicy != admissionregistrationv1.Ignore && failurePolicy != admissionregistrationv1.Fail {
+		return nil, fmt.Errorf("invalid failure policy %q, expect %s or %s", o.FailurePolicy, admissionregistrationv1.Ignore, admissionregistrationv1.Fail)
+	}
+
+	namespaceSelector, err := metav1.ParseToLabelSelector(o.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"pods"},
+			},
+		},
+	}
+	if mutatePodTemplates {
+		groups := map[string][]string{}
+		var order []string
+		for _, gvr := range sortedPodTemplateResources() {
+			if _, ok := groups[gvr.Group]; !ok {
+				order = append(order, gvr.Group)
+			}
+			groups[gvr.Group] = append(groups[gvr.Group], gvr.Resource)
+		}
+		for _, group := range order {
+			rules = append(rules, admissionregistrationv1.RuleWithOperations{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{group},
+					APIVersions: []string{"v1"},
+					Resources:   groups[group],
+				},
+			})
+		}
+	}
+
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	reinvocationPolicy := admissionregistrationv1.IfNeededReinvocationPolicy
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: o.Name},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name:                    "coredump.fujitsu.com",
+				ClientConfig:            clientConfig,
+				Rules:                   rules,
+				FailurePolicy:           &failurePolicy,
+				NamespaceSelector:       namespaceSelector,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				ReinvocationPolicy:      &reinvocationPolicy,
+			},
+		},
+	}, nil
+}
+
+// registerWebhook creates the MutatingWebhookConfiguration, or updates it if it exists already.
+func registerWebhook(client kubernetes.Interface, config *admissionregistrationv1.MutatingWebhookConfiguration) error {
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	existing, err := configs.Get(context.TODO(), config.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configs.Create(context.TODO(), config, metav1.CreateOptions{})
+		if err == nil {
+			glog.Infof("created MutatingWebhookConfiguration %s", config.Name)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	updated := existing.DeepCopy()
+	updated.Webhooks = config.Webhooks
+	_, err = configs.Update(context.TODO(), updated, metav1.UpdateOptions{})
+	if err == nil {
+		glog.Infof("updated MutatingWebhookConfiguration %s", config.Name)
+	}
+	return err
+}
+
+// unregisterWebhook deletes the MutatingWebhookConfiguration if it exists.
+func unregisterWebhook(client kubernetes.Interface, name string) error {
+	err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		glog.Infof("deleted MutatingWebhookConfiguration %s", name)
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMutatingWebhookConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.Nil(t, ioutil.WriteFile(caFile, []byte("ca"), 0644))
+
+	o := RegistrationOptions{
+		Name:              "coredump",
+		CABundleFile:      caFile,
+		ServiceName:       "coredump-detector",
+		ServiceNamespace:  "default",
+		ServicePort:       443,
+		FailurePolicy:     "Ignore",
+		NamespaceSelector: "coredump notin (disabled)",
+	}
+	c, err := o.mutatingWebhookConfiguration(true)
+	require.Nil(t, err)
+	require.Len(t, c.Webhooks, 1)
+	webhook := c.Webhooks[0]
+	assert.Equal(t, []byte("ca"), webhook.ClientConfig.CABundle)
+	assert.Equal(t, "coredump-detector", webhook.ClientConfig.Service.Name)
+	assert.Equal(t, admissionregistrationv1.Ignore, *webhook.FailurePolicy)
+	assert.Equal(t, admissionregistrationv1.SideEffectClassNone, *webhook.SideEffects)
+	assert.Equal(t, "coredump", webhook.NamespaceSelector.MatchExpressions[0].Key)
+	assert.Equal(t, []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule:       admissionregistrationv1.Rule{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}},
+		},
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule:       admissionregistrationv1.Rule{APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"daemonsets", "deployments", "replicasets", "statefulsets"}},
+		},
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule:       admissionregistrationv1.Rule{APIGroups: []string{"batch"}, APIVersions: []string{"v1"}, Resources: []string{"cronjobs", "jobs"}},
+		},
+	}, webhook.Rules)
+
+	// invalid options
+	for _, modify := range []func(o *RegistrationOptions){
+		func(o *RegistrationOptions) { o.URL = "https://10.167.133.33/" },
+		func(o *RegistrationOptions) { o.ServiceName = "" },
+		func(o *RegistrationOptions) { o.FailurePolicy = "Retry" },
+		func(o *RegistrationOptions) { o.NamespaceSelector = "in in in" },
+		func(o *RegistrationOptions) { o.CABundleFile = filepath.Join(dir, "missing") },
+		func(o *RegistrationOptions) { o.CABundleFile = "" },
+	} {
+		invalid := o
+		modify(&invalid)
+		_, err := invalid.mutatingWebhookConfiguration(false)
+		assert.NotNil(t, err, "options %+v should be invalid", invalid)
+	}
+}
+
+func TestRegisterWebhook(t *testing.T) {
+	// NewClientset fails the writes of the vendored API types, whose package paths
+	// don't match their OpenAPI names, so the writes are tracked without managed fields.
+	client := fake.NewSimpleClientset()
+	newConfig := func(caBundle string) *admissionregistrationv1.MutatingWebhookConfiguration {
+		return &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "coredump"},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{{
+				Name:         "coredump.fujitsu.com",
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte(caBundle)},
+			}},
+		}
+	}
+
+	// created
+	require.Nil(t, registerWebhook(client, newConfig("old ca")))
+	c, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "coredump", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, []byte("old ca"), c.Webhooks[0].ClientConfig.CABundle)
+
+	// updated
+	require.Nil(t, registerWebhook(client, newConfig("new ca")))
+	c, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "coredump", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, []byte("new ca"), c.Webhooks[0].ClientConfig.CABundle)
+
+	// deleted, twice
+	require.Nil(t, unregisterWebhook(client, "coredump"))
+	_, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "coredump", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.Nil(t, unregisterWebhook(client, "coredump"))
+}
@@ -0,0 +1,211 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+// preferredNodeAffinityWeight is the weight of the preferred node affinity term
+// added with the PreferredNodeAffinity node placement.
+const preferredNodeAffinityWeight = 100
+
+// scheduleToCoredumpNodes keeps the pod of spec on the nodes matching the node selector
+// of the config, in the way its node placement asks for, and adds its tolerations.
+// A node selector or a required node affinity term of the pod which can't be satisfied
+// together with the node selector of the config is an error, rather than being
+// overridden. Like injectCoredumpVolume, calling it on its own output changes nothing.
+func scheduleToCoredumpNodes(spec *corev1.PodSpec) error {
+	requirements := coredumpNodeRequirements()
+	for _, requirement := range requirements {
+		if value, ok := spec.NodeSelector[requirement.Key]; ok && value != requirement.Values[0] {
+			return fmt.Errorf("the node selector %s=%s of the pod conflicts with %s=%s of the nodes that support coredump",
+				requirement.Key, value, requirement.Key, requirement.Values[0])
+		}
+	}
+
+	switch config.NodePlacement {
+	case configv1alpha1.NodePlacementRequired:
+		if err := requireNodeAffinity(spec, requirements); err != nil {
+			return err
+		}
+	case configv1alpha1.NodePlacementPreferred:
+		if err := preferNodeAffinity(spec, requirements); err != nil {
+			return err
+		}
+	default:
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		for _, requirement := range requirements {
+			spec.NodeSelector[requirement.Key] = requirement.Values[0]
+		}
+	}
+
+	for i := range config.Tolerations {
+		tolerated := false
+		for j := range spec.Tolerations {
+			tolerated = tolerated || spec.Tolerations[j].MatchToleration(&config.Tolerations[i])
+		}
+		if !tolerated {
+			spec.Tolerations = append(spec.Tolerations, config.Tolerations[i])
+		}
+	}
+	return nil
+}
+
+// coredumpNodeRequirements returns the node selector of the config as node selector
+// requirements, ordered by key.
+func coredumpNodeRequirements() []corev1.NodeSelectorRequirement {
+	var requirements []corev1.NodeSelectorRequirement
+	for k, v := range config.NodeSelector {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{Key: k, Operator: corev1.NodeSelectorOpIn, Values: []string{v}})
+	}
+	sort.Slice(requirements, func(i, j int) bool { return requirements[i].Key < requirements[j].Key })
+	return requirements
+}
+
+// requireNodeAffinity adds requirements to every term of the required node affinity of spec,
+// or to a new term if it has none. The terms are ORed, so every one of them must
+// require the nodes that support coredump.
+func requireNodeAffinity(spec *corev1.PodSpec, requirements []corev1.NodeSelectorRequirement) error {
+	nodeAffinity := podNodeAffinity(spec)
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(required.NodeSelectorTerms) == 0 {
+		required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		if err := checkNodeSelectorTerm(*term, requirements); err != nil {
+			return fmt.Errorf("term %d of the required node affinity of the pod %v", i, err)
+		}
+		for _, requirement := range requirements {
+			if !hasNodeSelectorRequirement(term.MatchExpressions, requirement) {
+				term.MatchExpressions = append(term.MatchExpressions, requirement)
+			}
+		}
+	}
+	return nil
+}
+
+// preferNodeAffinity adds a preferred node affinity term of requirements to spec. It is an
+// error if no term of the required node affinity of spec allows the nodes that support coredump.
+func preferNodeAffinity(spec *corev1.PodSpec, requirements []corev1.NodeSelectorRequirement) error {
+	nodeAffinity := podNodeAffinity(spec)
+	if required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil && len(required.NodeSelectorTerms) != 0 {
+		var err error
+		for _, term := range required.NodeSelectorTerms {
+			if err = checkNodeSelectorTerm(term, requirements); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("every term of the required node affinity of the pod excludes the nodes that support coredump, e.g. it %v", err)
+		}
+	}
+	for _, preferred := range nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		if len(preferred.Preference.MatchExpressions) != len(requirements) {
+			continue
+		}
+		found := true
+		for _, requirement := range requirements {
+			found = found && hasNodeSelectorRequirement(preferred.Preference.MatchExpressions, requirement)
+		}
+		if found {
+			return nil
+		}
+	}
+	nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		corev1.PreferredSchedulingTerm{
+			Weight:     preferredNodeAffinityWeight,
+			Preference: corev1.NodeSelectorTerm{MatchExpressions: requirements},
+		})
+	return nil
+}
+
+// podNodeAffinity returns the node affinity of spec, creating it if it is nil.
+func podNodeAffinity(spec *corev1.PodSpec) *corev1.NodeAffinity {
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	return spec.Affinity.NodeAffinity
+}
+
+// checkNodeSelectorTerm ensures that the match expressions of term allow the label
+// values of requirements. The match fields are not checked.
+func checkNodeSelectorTerm(term corev1.NodeSelectorTerm, requirements []corev1.NodeSelectorRequirement) error {
+	for _, requirement := range requirements {
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == requirement.Key && !labelValueMatches(expression, requirement.Values[0]) {
+				return fmt.Errorf("requires %s %s %v, which conflicts with %s=%s of the nodes that support coredump",
+					expression.Key, expression.Operator, expression.Values, requirement.Key, requirement.Values[0])
+			}
+		}
+	}
+	return nil
+}
+
+// labelValueMatches reports whether a node with the label value for the key of
+// expression matches it.
+func labelValueMatches(expression corev1.NodeSelectorRequirement, value string) bool {
+	switch expression.Operator {
+	case corev1.NodeSelectorOpIn, corev1.NodeSelectorOpNotIn:
+		in := false
+		for _, v := range expression.Values {
+			in = in || v == value
+		}
+		return in == (expression.Operator == corev1.NodeSelectorOpIn)
+	case corev1.NodeSelectorOpExists:
+		return true
+	case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+		if len(expression.Values) != 1 {
+			return false
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		bound, err := strconv.ParseInt(expression.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+		return (expression.Operator == corev1.NodeSelectorOpGt && n > bound) || (expression.Operator == corev1.NodeSelectorOpLt && n < bound)
+	}
+	// DoesNotExist, and whatever the kube-apiserver doesn't know either
+	return false
+}
+
+// hasNodeSelectorRequirement reports whether expressions contain requirement already.
+func hasNodeSelectorRequirement(expressions []corev1.NodeSelectorRequirement, requirement corev1.NodeSelectorRequirement) bool {
+	for _, expression := range expressions {
+		if expression.Key == requirement.Key && expression.Operator == requirement.Operator &&
+			len(expression.Values) == 1 && expression.Values[0] == requirement.Values[0] {
+			return true
+		}
+	}
+	return false
+}
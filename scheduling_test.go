@@ -0,0 +1,167 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+func TestScheduleToCoredumpNodes(t *testing.T) {
+	defaultConfig := config
+	defer func() { config = defaultConfig }()
+
+	coredump := corev1.NodeSelectorRequirement{Key: "coredump", Operator: corev1.NodeSelectorOpIn, Values: []string{"true"}}
+	zone := corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a", "b"}}
+	toleration := corev1.Toleration{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "coredump", Effect: corev1.TaintEffectNoSchedule}
+	testCases := []struct {
+		placement     configv1alpha1.NodePlacement
+		spec          corev1.PodSpec
+		expectedSpec  corev1.PodSpec
+		expectedError string
+	}{
+		{
+			// the default placement
+			spec: corev1.PodSpec{NodeSelector: map[string]string{"disk": "ssd"}},
+			expectedSpec: corev1.PodSpec{
+				NodeSelector: map[string]string{"disk": "ssd", "coredump": "true"},
+				Tolerations:  []corev1.Toleration{toleration},
+			},
+		},
+		{
+			placement:     configv1alpha1.NodePlacementNodeSelector,
+			spec:          corev1.PodSpec{NodeSelector: map[string]string{"coredump": "false"}},
+			expectedError: "the node selector coredump=false of the pod conflicts with coredump=true",
+		},
+		{
+			placement: configv1alpha1.NodePlacementRequired,
+			spec:      corev1.PodSpec{Tolerations: []corev1.Toleration{toleration}},
+			expectedSpec: corev1.PodSpec{
+				Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{coredump}},
+					}},
+				}},
+				Tolerations: []corev1.Toleration{toleration},
+			},
+		},
+		{
+			// every term is ANDed with the node selector
+			placement: configv1alpha1.NodePlacementRequired,
+			spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{zone}},
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "coredump", Operator: corev1.NodeSelectorOpExists}}},
+				}},
+			}}},
+			expectedSpec: corev1.PodSpec{
+				Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{zone, coredump}},
+						{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "coredump", Operator: corev1.NodeSelectorOpExists}, coredump}},
+					}},
+				}},
+				Tolerations: []corev1.Toleration{toleration},
+			},
+		},
+		{
+			placement: configv1alpha1.NodePlacementRequired,
+			spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{zone}},
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "coredump", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"true"}}}},
+				}},
+			}}},
+			expectedError: "term 1 of the required node affinity of the pod requires coredump NotIn [true]",
+		},
+		{
+			placement: configv1alpha1.NodePlacementPreferred,
+			spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "coredump", Operator: corev1.NodeSelectorOpDoesNotExist}}},
+					{MatchExpressions: []corev1.NodeSelectorRequirement{zone}},
+				}},
+			}}},
+			expectedSpec: corev1.PodSpec{
+				Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "coredump", Operator: corev1.NodeSelectorOpDoesNotExist}}},
+						{MatchExpressions: []corev1.NodeSelectorRequirement{zone}},
+					}},
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+						{Weight: 100, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{coredump}}},
+					},
+				}},
+				Tolerations: []corev1.Toleration{toleration},
+			},
+		},
+		{
+			placement: configv1alpha1.NodePlacementPreferred,
+			spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "coredump", Operator: corev1.NodeSelectorOpDoesNotExist}}},
+				}},
+			}}},
+			expectedError: "every term of the required node affinity of the pod excludes the nodes that support coredump",
+		},
+	}
+
+	for i, tc := range testCases {
+		config = &configv1alpha1.Configuration{
+			NodeSelector:  map[string]string{"coredump": "true"},
+			NodePlacement: tc.placement,
+			Tolerations:   []corev1.Toleration{toleration},
+		}
+		spec := tc.spec.DeepCopy()
+		err := scheduleToCoredumpNodes(spec)
+		if len(tc.expectedError) != 0 {
+			require.NotNil(t, err, "test %d: expected an error", i)
+			assert.Contains(t, err.Error(), tc.expectedError, "test %d", i)
+			continue
+		}
+		require.Nil(t, err, "test %d", i)
+		assert.Equal(t, tc.expectedSpec, *spec, "test %d", i)
+
+		// scheduling the mutated pod again changes nothing
+		require.Nil(t, scheduleToCoredumpNodes(spec), "test %d", i)
+		assert.Equal(t, tc.expectedSpec, *spec, "test %d: not idempotent", i)
+	}
+}
+
+func TestLabelValueMatches(t *testing.T) {
+	testCases := []struct {
+		expression corev1.NodeSelectorRequirement
+		value      string
+		expected   bool
+	}{
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpIn, Values: []string{"a", "b"}}, value: "b", expected: true},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}, value: "b"},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpNotIn, Values: []string{"a"}}, value: "b", expected: true},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpNotIn, Values: []string{"b"}}, value: "b"},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpExists}, value: "b", expected: true},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpDoesNotExist}, value: "b"},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpGt, Values: []string{"1"}}, value: "2", expected: true},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpLt, Values: []string{"1"}}, value: "2"},
+		{expression: corev1.NodeSelectorRequirement{Operator: corev1.NodeSelectorOpGt, Values: []string{"1"}}, value: "true"},
+	}
+	for i, tc := range testCases {
+		assert.Equal(t, tc.expected, labelValueMatches(tc.expression, tc.value), "test %d", i)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+	"github.com/CaoShuFeng/coredump-detector/pkg/ratelimit"
+)
+
+// coreLimit enforces the CoreLimit of the configuration. The cores of a container
+// beyond MaxCores in Interval are suppressed, only their metadata is saved.
+// With KeepLast, the latest suppressed cores are saved anyway and the older ones
+// are deleted as newer ones come, so the first and the last cores of a crash storm
+// are kept.
+type coreLimit struct {
+	// limiter counts the cores of every container.
+	limiter *ratelimit.Limiter
+	// keepLast is the number of the latest suppressed cores which are saved.
+	keepLast int
+	// dir keeps the list of the suppressed cores saved for every container.
+	dir string
+}
+
+// newCoreLimit returns the coreLimit of limit keeping its state in stateDir, or nil
+// if the cores are not limited.
+func newCoreLimit(limit configv1alpha1.CoreLimit, stateDir string) *coreLimit {
+	if limit.MaxCores == nil {
+		return nil
+	}
+	l := &coreLimit{
+		limiter: &ratelimit.Limiter{
+			Dir:      filepath.Join(stateDir, "cores"),
+			Burst:    int(*limit.MaxCores),
+			Interval: time.Hour,
+		},
+		dir: filepath.Join(stateDir, "kept"),
+	}
+	if limit.Interval != nil {
+		l.limiter.Interval = limit.Interval.Duration
+	}
+	if limit.KeepLast != nil {
+		l.keepLast = int(*limit.KeepLast)
+	}
+	return l
+}
+
+// coreLimitKey returns the key the cores of a container are counted with. source is
+// the root of the mount at the mount path of the container, whose last element is
+// the container name, so the cores of the restarts of a container are counted together.
+func coreLimitKey(podUID, source string) string {
+	return podUID + "_" + path.Base(source)
+}
+
+// allow reports whether the core of key dumped at now is saved. When it is not,
+// suppressed is the number of the cores of key suppressed since it was last quiet,
+// this one included.
+func (l *coreLimit) allow(key string, now time.Time) (suppressed int, err error) {
+	allowed, denied, err := l.limiter.Allow(key, now)
+	if err != nil || allowed {
+		return 0, err
+	}
+	return denied, nil
+}
+
+// keptCore is a suppressed core saved anyway.
+type keptCore struct {
+	// Name is the name of the core file in the mount path of the container.
+	Name string `json:"name"`
+	// Namespace and CoreDump name the CoreDump of the core, if it was recorded.
+	Namespace string `json:"namespace,omitempty"`
+	CoreDump  string `json:"coreDump,omitempty"`
+}
+
+// keep adds core to the suppressed cores saved for key, and returns the ones beyond
+// the latest keepLast, oldest first, which are forgotten and should be deleted.
+// The cores saved in an earlier crash storm are forgotten but not returned when
+// first is true, so they stay.
+func (l *coreLimit) keep(key string, core keptCore, first bool) ([]keptCore, error) {
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, key), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return nil, &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+
+	var kept []keptCore
+	scanner := bufio.NewScanner(f)
+	for !first && scanner.Scan() {
+		var k keptCore
+		if err := json.Unmarshal(scanner.Bytes(), &k); err != nil || len(k.Name) == 0 || strings.Contains(k.Name, "/") {
+			// ignore what we didn't write
+			continue
+		}
+		kept = append(kept, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	kept = append(kept, core)
+	var evicted []keptCore
+	if len(kept) > l.keepLast {
+		evicted = kept[:len(kept)-l.keepLast]
+		kept = kept[len(kept)-l.keepLast:]
+	}
+
+	var buf []byte
+	for _, k := range kept {
+		line, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		return nil, err
+	}
+	return evicted, f.Close()
+}
+
+// prune forgets the containers without cores in the interval before now.
+func (l *coreLimit) prune(now time.Time) error {
+	if err := l.limiter.Prune(now); err != nil {
+		return err
+	}
+	kept := &ratelimit.Limiter{Dir: l.dir, Interval: l.limiter.Interval}
+	return kept.Prune(now)
+}
@@ -0,0 +1,55 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoreLimitKeep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l := &coreLimit{keepLast: 2, dir: dir}
+	testCases := []struct {
+		name            string
+		first           bool
+		expectedEvicted []keptCore
+	}{
+		{name: "a", first: true},
+		{name: "b"},
+		{name: "c", expectedEvicted: []keptCore{{Name: "a"}}},
+		{name: "d", expectedEvicted: []keptCore{{Name: "b"}}},
+		// a new crash storm, the last cores of the previous one stay
+		{name: "e", first: true},
+		{name: "f"},
+		{name: "g", expectedEvicted: []keptCore{{Name: "e"}}},
+	}
+	for i, tc := range testCases {
+		evicted, err := l.keep("uid_nginx", keptCore{Name: tc.name}, tc.first)
+		require.Nil(t, err, "test %d", i)
+		assert.Equal(t, tc.expectedEvicted, evicted, "test %d", i)
+	}
+}
+
+func TestCoreLimitKey(t *testing.T) {
+	assert.Equal(t, "uid_nginx", coreLimitKey("uid", "/exports/nginx-1/nginx"))
+}
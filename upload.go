@@ -0,0 +1,205 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/retention"
+	"github.com/CaoShuFeng/coredump-detector/pkg/s3"
+)
+
+// uploadOptions contains the options of `coredump-detector upload`
+type uploadOptions struct {
+	Dir       string
+	Namespace string
+	Endpoint  string
+	Bucket    string
+	Region    string
+	PartSize  int64
+	Retries   int
+	MinAge    time.Duration
+	Interval  time.Duration
+	Delete    bool
+	Once      bool
+}
+
+func (o *uploadOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Dir, "dir", o.Dir, "Where the claim holding the core files is mounted.")
+	fs.StringVar(&o.Namespace, "namespace", o.Namespace, ""+
+		"Namespace of the pods writing into the claim, the first part of the object keys. Defaults to the POD_NAMESPACE environment variable.")
+	fs.StringVar(&o.Endpoint, "endpoint", o.Endpoint, "URL of the S3 compatible service, e.g. https://s3.us-east-1.amazonaws.com.")
+	fs.StringVar(&o.Bucket, "bucket", o.Bucket, "Bucket to upload the core files to.")
+	fs.StringVar(&o.Region, "region", o.Region, "Region of the bucket.")
+	fs.Int64Var(&o.PartSize, "part-size", o.PartSize, "Size of the parts of multipart uploads in bytes. Smaller files are uploaded at once.")
+	fs.IntVar(&o.Retries, "retries", o.Retries, "How many times a failed request is retried.")
+	fs.DurationVar(&o.MinAge, "min-age", o.MinAge, ""+
+		"How long a core file is left alone after it is written, so that a core file written by the kernel is not uploaded before it is finished. "+
+		"The core files written by `coredump-detector handle` are only uploaded once they are finished anyway.")
+	fs.DurationVar(&o.Interval, "interval", o.Interval, "Interval between the scans of --dir.")
+	fs.BoolVar(&o.Delete, "delete", o.Delete, "Delete the core files once they are uploaded.")
+	fs.BoolVar(&o.Once, "once", o.Once, "Scan --dir once and exit, e.g. in a CronJob.")
+}
+
+// uploader uploads the core files of a claim, laid out as `<pod name>/<container name>/<core file>`,
+// to `<namespace>/<pod name>/<container name>/<core file>` in a bucket.
+type uploader struct {
+	client    *s3.Client
+	bucket    string
+	namespace string
+	minAge    time.Duration
+	delete    bool
+}
+
+// sync uploads the core files under dir which are older than minAge, together with
+// their sidecar files. The files still being written by `coredump-detector handle`,
+// which end with partialSuffix, and the files which are already in the bucket are
+// skipped, unless the latter are deleted after the upload.
+func (u *uploader) sync(ctx context.Context, dir string, now time.Time) error {
+	files, err := retention.Scan(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		if strings.HasSuffix(f.Path, partialSuffix) {
+			continue
+		}
+		// the sidecar files are written right after the core file is closed
+		if now.Sub(f.ModTime) < u.minAge {
+			continue
+		}
+		if err := u.upload(ctx, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// upload uploads the core file f and its sidecar files, the core file first.
+func (u *uploader) upload(ctx context.Context, f retention.File) error {
+	paths := append([]string{f.Path}, f.Sidecars...)
+	for _, p := range paths {
+		key := path.Join(u.namespace, f.Pod, f.Container, filepath.Base(p))
+		uploaded, err := u.uploadFile(ctx, p, key)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s to %s/%s: %v", p, u.bucket, key, err)
+		}
+		if uploaded {
+			glog.Infof("uploaded %s to %s/%s", p, u.bucket, key)
+		}
+	}
+	if !u.delete {
+		return nil
+	}
+	// the sidecar files first, so that a core file is never left without them
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := os.Remove(paths[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	glog.Infof("deleted the uploaded core file %s", f.Path)
+	return nil
+}
+
+// uploadFile uploads the file p to key, unless it is already there and is kept.
+func (u *uploader) uploadFile(ctx context.Context, p, key string) (bool, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !u.delete {
+		size, ok, err := u.client.Stat(ctx, u.bucket, key)
+		if err != nil {
+			return false, err
+		}
+		if ok && size == info.Size() {
+			return false, nil
+		}
+	}
+	return true, u.client.Upload(ctx, u.bucket, key, file, info.Size())
+}
+
+// runUpload implements `coredump-detector upload`. The credentials are read from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+func runUpload(args []string) error {
+	o := &uploadOptions{
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		Region:    "us-east-1",
+		PartSize:  s3.DefaultPartSize,
+		Retries:   5,
+		MinAge:    time.Minute,
+		Interval:  time.Minute,
+	}
+	fs := pflag.NewFlagSet("upload", pflag.ContinueOnError)
+	o.addFlags(fs)
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	defer glog.Flush()
+	for _, required := range []struct{ name, value string }{
+		{"dir", o.Dir}, {"namespace", o.Namespace}, {"endpoint", o.Endpoint}, {"bucket", o.Bucket},
+	} {
+		if len(required.value) == 0 {
+			return fmt.Errorf("--%s is required", required.name)
+		}
+	}
+	if o.PartSize < s3.MinPartSize {
+		return fmt.Errorf("--part-size must be at least %d", s3.MinPartSize)
+	}
+
+	u := &uploader{
+		client: &s3.Client{
+			Endpoint:        o.Endpoint,
+			Region:          o.Region,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			PartSize:        o.PartSize,
+			Retries:         o.Retries,
+		},
+		bucket:    o.Bucket,
+		namespace: o.Namespace,
+		minAge:    o.MinAge,
+		delete:    o.Delete,
+	}
+	if o.Once {
+		return u.sync(context.Background(), o.Dir, time.Now())
+	}
+	wait.Until(func() {
+		if err := u.sync(context.Background(), o.Dir, time.Now()); err != nil {
+			glog.Errorf("failed to upload the core files in %s: %v", o.Dir, err)
+		}
+	}, o.Interval, wait.NeverStop)
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/CaoShuFeng/coredump-detector/pkg/s3"
+)
+
+// fakeBucket is an S3 stand-in for small objects.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]string
+	puts    []string
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !strings.HasPrefix(r.URL.Path, "/cores/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/cores/")
+	switch r.Method {
+	case http.MethodHead:
+		data, ok := b.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		b.objects[key] = string(data)
+		b.puts = append(b.puts, key)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUploader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump-detector")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeCore := func(name, data string, age time.Duration) string {
+		p := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.Nil(t, ioutil.WriteFile(p, []byte(data), 0644))
+		require.Nil(t, os.Chtimes(p, now.Add(-age), now.Add(-age)))
+		return p
+	}
+	old := writeCore("nginx-1/nginx/core_nginx_1.1", "old core", time.Hour)
+	oldMetadata := writeCore("nginx-1/nginx/core_nginx_1.1.json", "{}", time.Hour)
+	recent := writeCore("nginx-1/nginx/core_nginx_2.2", "recent core", time.Second)
+	other := writeCore("nginx-2/sidecar/core_envoy_1.1.zst", "other core", time.Hour)
+	// still written by `coredump-detector handle`
+	partial := writeCore("nginx-2/sidecar/core_envoy_2.2.zst.partial", "partial core", time.Hour)
+
+	bucket := &fakeBucket{objects: map[string]string{}}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	u := &uploader{
+		client:    &s3.Client{Endpoint: server.URL, Region: "us-east-1", Backoff: time.Millisecond},
+		bucket:    "cores",
+		namespace: "default",
+		minAge:    time.Minute,
+	}
+
+	require.Nil(t, u.sync(context.TODO(), dir, now))
+	assert.Equal(t, map[string]string{
+		"default/nginx-1/nginx/core_nginx_1.1":       "old core",
+		"default/nginx-1/nginx/core_nginx_1.1.json":  "{}",
+		"default/nginx-2/sidecar/core_envoy_1.1.zst": "other core",
+	}, bucket.objects)
+	for _, p := range []string{old, oldMetadata, recent, other} {
+		_, err := os.Stat(p)
+		assert.Nil(t, err, "%s is deleted", p)
+	}
+
+	// the uploaded files are not uploaded again
+	bucket.puts = nil
+	require.Nil(t, u.sync(context.TODO(), dir, now.Add(time.Minute)))
+	assert.Equal(t, []string{"default/nginx-1/nginx/core_nginx_2.2"}, bucket.puts)
+
+	// deleted after the upload
+	u.delete = true
+	bucket.puts = nil
+	require.Nil(t, u.sync(context.TODO(), dir, now.Add(time.Minute)))
+	assert.Equal(t, 4, len(bucket.puts))
+	for _, p := range []string{old, oldMetadata, recent, other} {
+		_, err := os.Stat(p)
+		assert.True(t, os.IsNotExist(err), "%s is not deleted", p)
+	}
+	_, err = os.Stat(partial)
+	assert.Nil(t, err, "the partial core is deleted")
+
+	// nothing is deleted when the upload fails
+	failing := writeCore("nginx-1/nginx/core_nginx_3.3", "failing core", time.Hour)
+	u.bucket = "missing"
+	assert.NotNil(t, u.sync(context.TODO(), dir, now))
+	_, err = os.Stat(failing)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,113 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+// client is used to look up the persistent volume claims named in the pod annotation.
+var client kubernetes.Interface
+
+// validatePod does the following things
+// 1) check whether this is a pod creation request, if not return nil. (This is not expected to happen)
+// 2) check whether the pod contains the coredump annotation (`coredump.fujitsu.com/pvcname` by default), if not return Allow directly.
+// 3) reject the pod if the persistent volume claim does not exist in the pod namespace,
+// is not bound yet, or can't be mounted in ReadWriteMany mode. Nothing is checked with the HostPath volume backend.
+func validatePod(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	glog.V(2).Info("validating pods")
+
+	// check the resource
+	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	if ar.Request == nil || ar.Request.Resource != podResource {
+		glog.Errorf("expect resource to be %s", podResource)
+		return nil
+	}
+
+	// check the verb
+	if ar.Request.Operation != admissionv1.Create {
+		glog.Errorf("expect operation to be %s", admissionv1.Create)
+		return nil
+	}
+
+	// check pod annotation
+	pod := corev1.Pod{}
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &pod); err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+
+	metadataAccessor := meta.NewAccessor()
+	annots, err := metadataAccessor.Annotations(&pod)
+	if err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+
+	pvc := annots[config.AnnotationKey]
+	if len(pvc) == 0 {
+		// no key set, we do nothing
+		return allowAdmissionResponse()
+	}
+	if config.VolumeBackend == configv1alpha1.VolumeBackendHostPath {
+		// the annotation doesn't name a claim
+		return allowAdmissionResponse()
+	}
+
+	// the namespace of the request is set even when the pod itself leaves it empty
+	namespace := ar.Request.Namespace
+	claim, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), pvc, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return rejectAdmissionResponse(fmt.Errorf("persistent volume claim %q set in annotation %q does not exist in namespace %q",
+			pvc, config.AnnotationKey, namespace), http.StatusForbidden, reasonClaimNotFound)
+	}
+	if err != nil {
+		glog.Error(err)
+		return toAdmissionResponse(err, http.StatusInternalServerError)
+	}
+	if reason, err := checkClaim(claim); err != nil {
+		return rejectAdmissionResponse(err, http.StatusForbidden, reason)
+	}
+	return allowAdmissionResponse()
+}
+
+// checkClaim ensures that the claim is bound to a volume which could be mounted read-write by many nodes.
+// The reason is returned together with the error.
+func checkClaim(claim *corev1.PersistentVolumeClaim) (string, error) {
+	if claim.Status.Phase != corev1.ClaimBound {
+		return reasonClaimNotBound, fmt.Errorf("persistent volume claim %q set in annotation %q is not bound, its phase is %q",
+			claim.Name, config.AnnotationKey, claim.Status.Phase)
+	}
+	for _, mode := range claim.Status.AccessModes {
+		if mode == corev1.ReadWriteMany {
+			return "", nil
+		}
+	}
+	return reasonClaimNotRWX, fmt.Errorf("persistent volume claim %q set in annotation %q is not %s, its access modes are %v",
+		claim.Name, config.AnnotationKey, corev1.ReadWriteMany, claim.Status.AccessModes)
+}
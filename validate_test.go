@@ -0,0 +1,144 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+func newClaim(name string, phase corev1.PersistentVolumeClaimPhase, modes ...corev1.PersistentVolumeAccessMode) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns1"},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Phase:       phase,
+			AccessModes: modes,
+		},
+	}
+}
+
+type validateTestCase struct {
+	annotations      map[string]string
+	claims           []runtime.Object
+	expectedResponse *admissionv1.AdmissionResponse
+}
+
+var validateTestCases = []validateTestCase{
+	{
+		// no annotation set, do nothing
+		expectedResponse: &admissionv1.AdmissionResponse{Allowed: true},
+	},
+	{
+		// bound rwx claim
+		annotations:      map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+		claims:           []runtime.Object{newClaim("pvc1", corev1.ClaimBound, corev1.ReadWriteOnce, corev1.ReadWriteMany)},
+		expectedResponse: &admissionv1.AdmissionResponse{Allowed: true},
+	},
+	{
+		// missing claim
+		annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc2"},
+		claims:      []runtime.Object{newClaim("pvc1", corev1.ClaimBound, corev1.ReadWriteMany)},
+		expectedResponse: &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: `persistent volume claim "pvc2" set in annotation "coredump.fujitsu.com/pvcname" does not exist in namespace "ns1"`,
+				Code:    http.StatusForbidden,
+			},
+		},
+	},
+	{
+		// claim not bound
+		annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+		claims:      []runtime.Object{newClaim("pvc1", corev1.ClaimPending)},
+		expectedResponse: &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: `persistent volume claim "pvc1" set in annotation "coredump.fujitsu.com/pvcname" is not bound, its phase is "Pending"`,
+				Code:    http.StatusForbidden,
+			},
+		},
+	},
+	{
+		// claim is not rwx
+		annotations: map[string]string{"coredump.fujitsu.com/pvcname": "pvc1"},
+		claims:      []runtime.Object{newClaim("pvc1", corev1.ClaimBound, corev1.ReadWriteOnce)},
+		expectedResponse: &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: `persistent volume claim "pvc1" set in annotation "coredump.fujitsu.com/pvcname" is not ReadWriteMany, its access modes are [ReadWriteOnce]`,
+				Code:    http.StatusForbidden,
+			},
+		},
+	},
+}
+
+func TestValidatePod(t *testing.T) {
+	for i, tc := range validateTestCases {
+		client = fake.NewClientset(tc.claims...)
+		raw, err := runtime.Encode(jsonSerializer, &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod1",
+				Annotations: tc.annotations,
+			},
+		})
+		if err != nil {
+			t.Fatalf("test[%d] fatal: %v", i, err)
+		}
+		response := validatePod(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{
+				Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+				Operation: admissionv1.Create,
+				Namespace: "ns1",
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		assert.Equal(t, tc.expectedResponse, response, fmt.Sprintf("test %d: unexpected response", i))
+	}
+}
+
+func TestValidatePodHostPath(t *testing.T) {
+	defaultConfig := config
+	defer func() { config = defaultConfig }()
+	config = defaultConfig.DeepCopy()
+	config.VolumeBackend = configv1alpha1.VolumeBackendHostPath
+
+	client = fake.NewClientset()
+	raw, err := runtime.Encode(jsonSerializer, &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod1",
+			Annotations: map[string]string{"coredump.fujitsu.com/pvcname": "true"},
+		},
+	})
+	require.Nil(t, err)
+	response := validatePod(admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			Resource:  metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"},
+			Operation: admissionv1.Create,
+			Namespace: "ns1",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	assert.Equal(t, &admissionv1.AdmissionResponse{Allowed: true}, response)
+}
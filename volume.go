@@ -0,0 +1,185 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	configv1alpha1 "github.com/CaoShuFeng/coredump-detector/pkg/apis/config/v1alpha1"
+)
+
+// storageClassAnnotation asks for a generic ephemeral volume of the storage class to
+// save the core files of the pod in, instead of the shared claim named in the
+// annotation of the config. The kube-controller-manager creates a claim
+// `<pod name>-coredump` for every pod and deletes it with the pod.
+const storageClassAnnotation = "coredump.fujitsu.com/storageclass"
+
+// defaultEphemeralVolumeSize is the size of the ephemeral volumes when the config
+// doesn't set one.
+var defaultEphemeralVolumeSize = resource.MustParse("10Gi")
+
+// defaultHostPath is the directory of the nodes holding the host path volumes when
+// the config doesn't set one.
+const defaultHostPath = "/var/lib/coredump"
+
+// hostPathDir returns the directory of the nodes holding the host path volumes.
+func hostPathDir(c *configv1alpha1.Configuration) string {
+	if len(c.HostPath.Path) != 0 {
+		return c.HostPath.Path
+	}
+	return defaultHostPath
+}
+
+// coredumpVolume returns the coredump volume asked for by annots of a pod in namespace:
+// the claim named in the annotation of the config, or the directory of the namespace
+// in the host path with the HostPath volume backend, or an ephemeral volume of the
+// storageClassAnnotation. It returns nil if annots ask for none, and an error if
+// they ask for more than one.
+func coredumpVolume(namespace string, annots map[string]string) (*corev1.Volume, error) {
+	pvc, storageClass := annots[config.AnnotationKey], annots[storageClassAnnotation]
+	switch {
+	case len(pvc) != 0 && len(storageClass) != 0:
+		return nil, fmt.Errorf("annotations %s and %s can't be set together", config.AnnotationKey, storageClassAnnotation)
+	case len(pvc) != 0 && config.VolumeBackend == configv1alpha1.VolumeBackendHostPath:
+		if len(namespace) == 0 {
+			return nil, fmt.Errorf("the namespace of the pod is unknown")
+		}
+		// the kubelet creates `<pod uid>/<container name>` in it for the sub path of every mount
+		directoryOrCreate := corev1.HostPathDirectoryOrCreate
+		return &corev1.Volume{
+			Name: coredumpVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: path.Join(hostPathDir(config), namespace),
+					Type: &directoryOrCreate,
+				},
+			},
+		}, nil
+	case len(pvc) != 0:
+		return &corev1.Volume{
+			Name: coredumpVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: pvc,
+					ReadOnly:  false,
+				},
+			},
+		}, nil
+	case len(storageClass) != 0:
+		if msgs := validation.IsDNS1123Subdomain(storageClass); len(msgs) != 0 {
+			return nil, fmt.Errorf("invalid storage class %q in annotation %s: %v", storageClass, storageClassAnnotation, msgs)
+		}
+		size := defaultEphemeralVolumeSize
+		if config.EphemeralVolumeSize != nil {
+			size = *config.EphemeralVolumeSize
+		}
+		return &corev1.Volume{
+			Name: coredumpVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Ephemeral: &corev1.EphemeralVolumeSource{
+					VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{
+						Spec: corev1.PersistentVolumeClaimSpec{
+							// the volume is only used by the pod
+							AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+							StorageClassName: &storageClass,
+							Resources: corev1.VolumeResourceRequirements{
+								Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+							},
+						},
+					},
+				},
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+// describeCoredumpVolume returns how volume is called in the error messages.
+func describeCoredumpVolume(volume corev1.Volume) string {
+	if volume.PersistentVolumeClaim != nil {
+		return volume.PersistentVolumeClaim.ClaimName
+	}
+	if volume.HostPath != nil {
+		return fmt.Sprintf("host path %s", volume.HostPath.Path)
+	}
+	if volume.Ephemeral != nil && volume.Ephemeral.VolumeClaimTemplate != nil && volume.Ephemeral.VolumeClaimTemplate.Spec.StorageClassName != nil {
+		return fmt.Sprintf("ephemeral volume of storage class %s", *volume.Ephemeral.VolumeClaimTemplate.Spec.StorageClassName)
+	}
+	return volume.Name
+}
+
+// sameCoredumpVolume reports whether existing is the coredump volume injected before.
+// The ephemeral volumes are compared by the storage class only, because the
+// kube-apiserver fills in the defaults of their claim template.
+func sameCoredumpVolume(existing, volume corev1.Volume) bool {
+	if existing.Name != volume.Name {
+		return false
+	}
+	if volume.PersistentVolumeClaim != nil {
+		return existing.PersistentVolumeClaim != nil && existing.PersistentVolumeClaim.ClaimName == volume.PersistentVolumeClaim.ClaimName
+	}
+	if volume.HostPath != nil {
+		return existing.HostPath != nil && existing.HostPath.Path == volume.HostPath.Path
+	}
+	if volume.Ephemeral == nil || existing.Ephemeral == nil || existing.Ephemeral.VolumeClaimTemplate == nil {
+		return false
+	}
+	storageClass := existing.Ephemeral.VolumeClaimTemplate.Spec.StorageClassName
+	return storageClass != nil && *storageClass == *volume.Ephemeral.VolumeClaimTemplate.Spec.StorageClassName
+}
+
+// subPathVariable returns the environment variable expanded in the sub path of volume.
+// The directories of the host path volumes are named after the pod UID rather than
+// the pod name, so that the pods of a StatefulSet don't reuse them.
+func subPathVariable(volume corev1.Volume) string {
+	if volume.HostPath != nil {
+		return podUIDEnv
+	}
+	return podNameEnv
+}
+
+// coredumpClaimName returns the name of the claim of the coredump volume of pod, or an
+// empty string if it has none.
+func coredumpClaimName(pod *corev1.Pod) string {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name != coredumpVolumeName {
+			continue
+		}
+		if volume.PersistentVolumeClaim != nil {
+			return volume.PersistentVolumeClaim.ClaimName
+		}
+		if volume.Ephemeral != nil {
+			// the name of the claims created for generic ephemeral volumes
+			return pod.Name + "-" + volume.Name
+		}
+	}
+	return ""
+}
+
+// coredumpHostPath returns the directory of the node holding the coredump volume of pod,
+// or an empty string if it is not a host path volume.
+func coredumpHostPath(pod *corev1.Pod) string {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == coredumpVolumeName && volume.HostPath != nil {
+			return volume.HostPath.Path
+		}
+	}
+	return ""
+}